@@ -10,15 +10,212 @@
 #include <stddef.h>
 
 
-#if 0
-static inline int ip_is_fragment(struct __sk_buff *ctx, __u64 nhoff)
+/*Skips the IPv6 extension headers after the fixed header at *l4_offset and
+ * returns the protocol of the header left at *l4_offset. frag is set for
+ * fragments and later_frag for fragments other than the first, which have
+ * no L4 header. Truncated or longer chains return the extension header
+ * they stopped at, so the packet is accounted without ports.*/
+static __always_inline __u8 skip_ipv6_ext(struct __sk_buff *skb, __u8 nexthdr, __u16 *l4_offset,
+		__u32 *frag, __u32 *later_frag)
 {
-#define IP_MF                   0x2000
-#define IP_OFFSET               0x1FFF
-        return load_half(ctx, nhoff + offsetof(struct iphdr, frag_off))
-                & (IP_MF | IP_OFFSET);
+	__u16 offset = *l4_offset;
+#pragma unroll
+	for(int i = 0; i < IPV6_EXT_MAX; i++) {
+		__u8 *hdr = (__u8 *)(long)skb->data + offset;
+		if(((void *)(hdr + 8) > (void *)(long)(skb->data_end))) {
+			break;
+		}
+		if((nexthdr == IPPROTO_HOPOPTS) || (nexthdr == IPPROTO_ROUTING) ||
+				(nexthdr == IPPROTO_DSTOPTS)) {
+			nexthdr = hdr[0];
+			offset += (hdr[1] + 1) << 3;
+		} else if(nexthdr == IPPROTO_AH) {
+			nexthdr = hdr[0];
+			offset += (hdr[1] + 2) << 2;
+		} else if(nexthdr == IPPROTO_FRAGMENT) {
+			*frag = 1;
+			if(*(__be16 *)(hdr + 2) & bpf_htons(IPV6_FRAG_OFFSET)) {
+				*later_frag = 1;
+			}
+			nexthdr = hdr[0];
+			offset += 8;
+		} else {
+			break;
+		}
+	}
+	*l4_offset = offset;
+	return nexthdr;
+}
+
+/*Returns the buffer of the flow map the agent is not currently draining*/
+static __always_inline __u32 active_buffer(__u32 sel_idx)
+{
+	__u32 *sel = bpf_map_lookup_elem(&flow_map_sel, &sel_idx);
+	if (sel && *sel) {
+		return 1;
+	}
+	return 0;
+}
+
+/*Tells whether the agent asked for FLOW_EVENT_NEW and the flow is a new
+ * connection. TCP flows start with a SYN without ACK. Other flows are new
+ * unless the other buffer holds them, a flow continuing across a swap is
+ * inserted again before the agent drains that buffer.*/
+static __always_inline int flow_is_new(struct flow_event *event, void *other_map, void *key)
+{
+	__u32 config_idx = FLOW_CONFIG_NEW_EVENTS;
+	__u64 *enabled = bpf_map_lookup_elem(&flow_config, &config_idx);
+
+	if (!enabled || !*enabled) {
+		return 0;
+	}
+	if (event->l4.ip_proto == IPPROTO_TCP) {
+		return (event->tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN;
+	}
+	return bpf_map_lookup_elem(other_map, key) == NULL;
+}
+
+/*Notifies the agent of a new connection, and once the buffer reaches the
+ * fill threshold. Concurrent inserts may rarely skip the threshold, the
+ * periodic scan still drains the buffer.*/
+static __always_inline void flow_created(struct __sk_buff *skb, struct flow_event *event,
+		void *other_map, void *key)
+{
+	__u32 count_idx = event->family * 2 + event->buffer;
+	__u64 *count = bpf_map_lookup_elem(&flow_counts, &count_idx);
+	__u64 *threshold = bpf_map_lookup_elem(&flow_config, &event->family);
+
+	if (flow_is_new(event, other_map, key)) {
+		event->type = FLOW_EVENT_NEW;
+		bpf_perf_event_output(skb, &flow_events, BPF_F_CURRENT_CPU, event, sizeof(*event));
+	}
+	if (!count) {
+		return;
+	}
+	__sync_fetch_and_add(count, 1);
+	if (threshold && *threshold && *count == *threshold) {
+		event->type = FLOW_EVENT_FILL;
+		bpf_perf_event_output(skb, &flow_events, BPF_F_CURRENT_CPU, event, sizeof(*event));
+	}
+}
+
+/*Notifies the agent of the first FIN of each direction and the first RST
+ * of a TCP flow in the buffer, seen_flags being the flags the buffer held
+ * for the direction of the packet before it. The agent keeps the flags of
+ * the drained buffers and finalizes the flow on the event that completes
+ * the close, retransmitted FINs and the ACKs that follow send nothing.*/
+static __always_inline void flow_closing(struct __sk_buff *skb, __u32 seen_flags,
+		struct flow_event *event)
+{
+	if (!(event->tcp_flags & (TCP_FLAG_FIN | TCP_FLAG_RST) & ~seen_flags)) {
+		return;
+	}
+	event->type = FLOW_EVENT_CLOSE;
+	bpf_perf_event_output(skb, &flow_events, BPF_F_CURRENT_CPU, event, sizeof(*event));
+}
+
+/*Counts the TCP flags of a packet of an existing flow*/
+static __always_inline void count_tcp_flags(struct flow_stats *value, __u32 tcp_flags)
+{
+	if ((tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN) {
+		__sync_fetch_and_add(&value->syn_count, 1);
+	} else if ((tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == (TCP_FLAG_SYN | TCP_FLAG_ACK)) {
+		__sync_fetch_and_add(&value->syn_ack_count, 1);
+	}
+	if (tcp_flags & TCP_FLAG_FIN) {
+		__sync_fetch_and_add(&value->fin_count, 1);
+	}
+	if (tcp_flags & TCP_FLAG_RST) {
+		__sync_fetch_and_add(&value->rst_count, 1);
+	}
+}
+
+/*Sets the TCP flag counters of a flow from its first packet*/
+static __always_inline void init_tcp_flags(struct flow_stats *value, __u32 tcp_flags)
+{
+	value->syn_count = (tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN;
+	value->syn_ack_count = (tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == (TCP_FLAG_SYN | TCP_FLAG_ACK);
+	value->fin_count = (tcp_flags & TCP_FLAG_FIN) != 0;
+	value->rst_count = (tcp_flags & TCP_FLAG_RST) != 0;
+}
+
+/*Records the original destination of the socket of a new flow. The first
+ * egress packet of a socket also records the destination kube-proxy
+ * translated it to, which the reverse flow, still keyed with the service
+ * address, then reports as its backend.*/
+static __always_inline void record_flow_svc(struct __sk_buff *skb, void *flow_svc_map, void *key,
+		__be32 *remote_ip, enum cgroup_direction dir)
+{
+	__u64 cookie = bpf_get_socket_cookie(skb);
+	struct svc_dst *sd;
+
+	if (!cookie) {
+		return;
+	}
+	sd = bpf_map_lookup_elem(&sock_svc_map, &cookie);
+	if (!sd) {
+		return;
+	}
+	if (dir == CGROUP_EGRESS &&
+	    (remote_ip[0] != sd->svc_ip[0] || remote_ip[1] != sd->svc_ip[1] ||
+	     remote_ip[2] != sd->svc_ip[2] || remote_ip[3] != sd->svc_ip[3])) {
+		__builtin_memcpy(sd->backend_ip, remote_ip, 16);
+	}
+	bpf_map_update_elem(flow_svc_map, key, sd, BPF_ANY);
+}
+
+static __always_inline void count_flow_error(__u32 err_idx)
+{
+	__u64 *count = bpf_map_lookup_elem(&flow_errors, &err_idx);
+	if (count) {
+		*count += 1;
+	}
+}
+
+/*Accounts a packet whose flow could not be inserted to the cgroup of its
+ * socket, so that the agent can still attribute it to the pod*/
+static __always_inline void account_overflow(struct __sk_buff *skb, __u32 family,
+		struct flow_stats *init_stats, enum cgroup_direction dir, __u64 now)
+{
+	struct overflow_key key = {
+	    .cgroup_id = bpf_skb_cgroup_id(skb),
+	    .family = family,
+	    .padding = 0,
+	};
+	struct flow_stats *value;
+	/*The agent loads the helper call as 0 on kernels without
+	 * bpf_skb_cgroup_id, the packet then counts as an overflow drop*/
+	if (!key.cgroup_id) {
+		count_flow_error(family == FLOW_MAP_SEL_V4 ? FLOW_ERR_V4_OVERFLOW : FLOW_ERR_V6_OVERFLOW);
+		return;
+	}
+	value = bpf_map_lookup_elem(&flow_overflow_map, &key);
+	if (!value) {
+		if (bpf_map_update_elem(&flow_overflow_map, &key, init_stats, BPF_ANY)) {
+			count_flow_error(family == FLOW_MAP_SEL_V4 ? FLOW_ERR_V4_OVERFLOW : FLOW_ERR_V6_OVERFLOW);
+		}
+		return;
+	}
+	value->last_seen_ns = now;
+	if (dir == CGROUP_INGRESS) {
+		__sync_fetch_and_add(&value->out_bytes, skb->len);
+		__sync_fetch_and_add(&value->out_packets, 1);
+	} else {
+		__sync_fetch_and_add(&value->in_bytes, skb->len);
+		__sync_fetch_and_add(&value->in_packets, 1);
+	}
+}
+
+/*Keys ICMP and ICMPv6 flows by type and code, set after normalizing so
+ * that they do not depend on the direction*/
+static __always_inline void set_icmp_key(struct proto_port *l4, __u8 icmp_type, __u8 icmp_code)
+{
+	if((l4->ip_proto != IPPROTO_ICMP) && (l4->ip_proto != IPPROTO_ICMPV6)) {
+		return;
+	}
+	l4->sport = bpf_htons(icmp_type);
+	l4->dport = bpf_htons(icmp_code);
 }
-#endif
 
 static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_direction dir)
 {
@@ -38,17 +235,45 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
         };
 
 	struct flow_stats *value = NULL;
+	void *flow_map = NULL;
+	__u32 tcp_flags = 0;
+	__u8 icmp_type = 0;
+	__u8 icmp_code = 0;
+	__u32 frag = 0;
+	__u32 later_frag = 0;
+	struct flow_event event;
+	__u64 now = bpf_ktime_get_ns();
         struct flow_stats init_cgroup_ingress_stats = {
 	    .out_packets = 1,
 	    .out_bytes = skb->len,
             .in_packets = 0,
             .in_bytes = 0,
+            .first_seen_ns = now,
+            .last_seen_ns = now,
+            .tcp_flags_out = 0,
+            .tcp_flags_in = 0,
+            .syn_count = 0,
+            .syn_ack_count = 0,
+            .fin_count = 0,
+            .rst_count = 0,
+            .out_frag_packets = 0,
+            .in_frag_packets = 0,
         };
         struct flow_stats init_cgroup_egress_stats = {
 	    .out_packets = 0,
 	    .out_bytes = 0,
             .in_packets = 1,
             .in_bytes = skb->len,
+            .first_seen_ns = now,
+            .last_seen_ns = now,
+            .tcp_flags_out = 0,
+            .tcp_flags_in = 0,
+            .syn_count = 0,
+            .syn_ack_count = 0,
+            .fin_count = 0,
+            .rst_count = 0,
+            .out_frag_packets = 0,
+            .in_frag_packets = 0,
         };
         struct iphdr *iph = (struct iphdr *)((void *)(long)skb->data);
 	if((void *)(iph+1) > (void *)(long)(skb->data_end)) {
@@ -59,13 +284,18 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 	    v4_key.src_ip = iph->saddr;
 	    v4_key.dst_ip = iph->daddr;
             __u16 l3_offset = ((iph->ihl)<<2);
+            /*Only the first fragment carries the L4 header*/
+            frag = (iph->frag_off & bpf_htons(IP_MF | IP_OFFSET)) != 0;
+            later_frag = (iph->frag_off & bpf_htons(IP_OFFSET)) != 0;
 	    /*Skip host loopback as these entries often flood the table*/
 	    /*Assuming loopback addresses would never be used directly in the context of
 	     * pods and services. It would be the host address if packet is self directed*/
 	    if((v4_key.src_ip == IPV4_LOOPBACK) || (v4_key.dst_ip == IPV4_LOOPBACK)) {
 		return 1;
 	    }
-            if(v4_key.l4.ip_proto == IPPROTO_TCP) {
+            if(later_frag) {
+		__builtin_memset(v4_key.l4.padding,0,sizeof(v4_key.l4.padding));
+            } else if(v4_key.l4.ip_proto == IPPROTO_TCP) {
                 struct tcphdr *tcph = (struct tcphdr *)((__u8 *)(long)(skb->data) + l3_offset);
                 if(((void *)(tcph + 1) > (void *)(long)(skb->data_end))) {
                     return 1;
@@ -73,6 +303,7 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 		v4_key.l4.sport = tcph->source;
 		v4_key.l4.dport = tcph->dest;
 		__builtin_memset(v4_key.l4.padding,0,sizeof(v4_key.l4.padding));
+		tcp_flags = ((__u8 *)tcph)[13];
             } else if (v4_key.l4.ip_proto == IPPROTO_UDP) {
                 struct udphdr *udph = (struct udphdr *)((__u8 *)(long)skb->data + l3_offset);
                 if(((void *)(udph + 1) > (void *)(long)(skb->data_end))) {
@@ -81,19 +312,56 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 		v4_key.l4.sport = udph->source;
 		v4_key.l4.dport = udph->dest;
 		__builtin_memset(v4_key.l4.padding,0,sizeof(v4_key.l4.padding));
+            } else if (v4_key.l4.ip_proto == IPPROTO_SCTP) {
+                /*The SCTP common header starts with the ports, like UDP*/
+                struct udphdr *sctph = (struct udphdr *)((__u8 *)(long)skb->data + l3_offset);
+                if(((void *)(sctph + 1) > (void *)(long)(skb->data_end))) {
+                    return 1;
+                }
+		v4_key.l4.sport = sctph->source;
+		v4_key.l4.dport = sctph->dest;
+		__builtin_memset(v4_key.l4.padding,0,sizeof(v4_key.l4.padding));
+            } else if (v4_key.l4.ip_proto == IPPROTO_ICMP) {
+                __u8 *icmph = (__u8 *)(long)skb->data + l3_offset;
+                if(((void *)(icmph + 2) > (void *)(long)(skb->data_end))) {
+                    return 1;
+                }
+		icmp_type = icmph[0];
+		icmp_code = icmph[1];
+		__builtin_memset(v4_key.l4.padding,0,sizeof(v4_key.l4.padding));
             }
 	    normalize_v4_flow(&v4_key, dir); 
-            value = bpf_map_lookup_elem(&v4_flow_map, &v4_key);
+	    set_icmp_key(&v4_key.l4, icmp_type, icmp_code);
+            __builtin_memset(&event, 0, sizeof(event));
+            event.family = FLOW_MAP_SEL_V4;
+            event.src_ip[0] = v4_key.src_ip;
+            event.dst_ip[0] = v4_key.dst_ip;
+            event.l4 = v4_key.l4;
+            event.tcp_flags = tcp_flags;
+            event.buffer = active_buffer(FLOW_MAP_SEL_V4);
+            flow_map = event.buffer ? (void *)&v4_flow_map_1 : (void *)&v4_flow_map;
+            value = bpf_map_lookup_elem(flow_map, &v4_key);
             if(!value) {
                 if( dir == CGROUP_INGRESS) {
+                    init_cgroup_ingress_stats.tcp_flags_out = tcp_flags;
+                    init_cgroup_ingress_stats.out_frag_packets = frag;
                     value = &init_cgroup_ingress_stats;
                 } else {
+                    init_cgroup_egress_stats.tcp_flags_in = tcp_flags;
+                    init_cgroup_egress_stats.in_frag_packets = frag;
                     value = &init_cgroup_egress_stats;
                 }
-                int ret = bpf_map_update_elem(&v4_flow_map, &v4_key, value, BPF_ANY);
+                init_tcp_flags(value, tcp_flags);
+                int ret = bpf_map_update_elem(flow_map, &v4_key, value, BPF_ANY);
                 if(ret) {
-                    char fmt[] = "Unable to update v4_flow_map:%d";
-                    bpf_trace_printk(fmt,sizeof(fmt),ret);
+                    count_flow_error(FLOW_ERR_V4_UPDATE);
+                    account_overflow(skb, FLOW_MAP_SEL_V4, value, dir, now);
+                } else {
+                    __be32 remote_ip[4] = {v4_key.src_ip, 0, 0, 0};
+                    record_flow_svc(skb, &v4_flow_svc_map, &v4_key, remote_ip, dir);
+                    flow_created(skb, &event, event.buffer ? (void *)&v4_flow_map : (void *)&v4_flow_map_1,
+                            &v4_key);
+                    flow_closing(skb, 0, &event);
                 }
                 return 1;
             }
@@ -103,10 +371,10 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 	    if(((void *)(ip6h + 1) > (void *)(long)(skb->data_end))) {
                 return 1;
 	    }
-            v6_key.l4.ip_proto = ip6h->nexthdr;
 	    __builtin_memcpy(&v6_key.src_ip, &ip6h->saddr, 16);
 	    __builtin_memcpy(&v6_key.dst_ip, &ip6h->daddr, 16);
             __u16 l3_offset = sizeof(struct ipv6hdr);
+            v6_key.l4.ip_proto = skip_ipv6_ext(skb, ip6h->nexthdr, &l3_offset, &frag, &later_frag);
 	    /*Skip host loopback as these entries often flood the table*/
 	    if(((v6_key.src_ip[0] == ipv6_lo[0]) && (v6_key.src_ip[1] == ipv6_lo[1]) &&
 			    (v6_key.src_ip[2] == ipv6_lo[2]) && (v6_key.src_ip[3] == ipv6_lo[3])) ||
@@ -114,7 +382,9 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 			    (v6_key.dst_ip[2] == ipv6_lo[2]) && (v6_key.dst_ip[3] == ipv6_lo[3]))) {
 		return 1;
 	    }
-            if(v6_key.l4.ip_proto == IPPROTO_TCP) {    
+            if(later_frag) {
+		__builtin_memset(v6_key.l4.padding,0,sizeof(v6_key.l4.padding));
+            } else if(v6_key.l4.ip_proto == IPPROTO_TCP) {    
                 struct tcphdr *tcph = (struct tcphdr *)((__u8 *)(long)(skb->data) + l3_offset);
                 if(((void *)(tcph + 1) > (void *)(long)(skb->data_end))) {
                     return 1;
@@ -122,6 +392,7 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 		v6_key.l4.sport = tcph->source;
 		v6_key.l4.dport = tcph->dest;
 		__builtin_memset(v6_key.l4.padding,0,sizeof(v6_key.l4.padding));
+		tcp_flags = ((__u8 *)tcph)[13];
             } else if (v6_key.l4.ip_proto == IPPROTO_UDP) {
                 struct udphdr *udph = (struct udphdr *)((__u8 *)(long)skb->data + l3_offset);
                 if(((void *)(udph + 1) > (void *)(long)(skb->data_end))) {
@@ -130,33 +401,87 @@ static __always_inline int bpf_flow_reader(struct __sk_buff *skb, enum cgroup_di
 		v6_key.l4.sport = udph->source;
 		v6_key.l4.dport = udph->dest;
 		__builtin_memset(v6_key.l4.padding,0,sizeof(v6_key.l4.padding));
+            } else if (v6_key.l4.ip_proto == IPPROTO_SCTP) {
+                /*The SCTP common header starts with the ports, like UDP*/
+                struct udphdr *sctph = (struct udphdr *)((__u8 *)(long)skb->data + l3_offset);
+                if(((void *)(sctph + 1) > (void *)(long)(skb->data_end))) {
+                    return 1;
+                }
+		v6_key.l4.sport = sctph->source;
+		v6_key.l4.dport = sctph->dest;
+		__builtin_memset(v6_key.l4.padding,0,sizeof(v6_key.l4.padding));
+            } else if (v6_key.l4.ip_proto == IPPROTO_ICMPV6) {
+                __u8 *icmph = (__u8 *)(long)skb->data + l3_offset;
+                if(((void *)(icmph + 2) > (void *)(long)(skb->data_end))) {
+                    return 1;
+                }
+		icmp_type = icmph[0];
+		icmp_code = icmph[1];
+		__builtin_memset(v6_key.l4.padding,0,sizeof(v6_key.l4.padding));
             } 
 	    normalize_v6_flow(&v6_key, dir); 
-            value = bpf_map_lookup_elem(&v6_flow_map, &v6_key);
+	    set_icmp_key(&v6_key.l4, icmp_type, icmp_code);
+            __builtin_memset(&event, 0, sizeof(event));
+            event.family = FLOW_MAP_SEL_V6;
+            __builtin_memcpy(event.src_ip, v6_key.src_ip, 16);
+            __builtin_memcpy(event.dst_ip, v6_key.dst_ip, 16);
+            event.l4 = v6_key.l4;
+            event.tcp_flags = tcp_flags;
+            event.buffer = active_buffer(FLOW_MAP_SEL_V6);
+            flow_map = event.buffer ? (void *)&v6_flow_map_1 : (void *)&v6_flow_map;
+            value = bpf_map_lookup_elem(flow_map, &v6_key);
             if(!value) {
                 if( dir == CGROUP_INGRESS) {
+                    init_cgroup_ingress_stats.tcp_flags_out = tcp_flags;
+                    init_cgroup_ingress_stats.out_frag_packets = frag;
                     value = &init_cgroup_ingress_stats;
                 } else {
+                    init_cgroup_egress_stats.tcp_flags_in = tcp_flags;
+                    init_cgroup_egress_stats.in_frag_packets = frag;
                     value = &init_cgroup_egress_stats;
                 }
-                int ret = bpf_map_update_elem(&v6_flow_map, &v6_key, value, BPF_ANY);
+                init_tcp_flags(value, tcp_flags);
+                int ret = bpf_map_update_elem(flow_map, &v6_key, value, BPF_ANY);
                 if(ret) {
-                    char fmt[] = "Unable to update v6_flow_map:%d";
-                    bpf_trace_printk(fmt,sizeof(fmt),ret);
+                    count_flow_error(FLOW_ERR_V6_UPDATE);
+                    account_overflow(skb, FLOW_MAP_SEL_V6, value, dir, now);
+                } else {
+                    record_flow_svc(skb, &v6_flow_svc_map, &v6_key, v6_key.src_ip, dir);
+                    flow_created(skb, &event, event.buffer ? (void *)&v6_flow_map : (void *)&v6_flow_map_1,
+                            &v6_key);
+                    flow_closing(skb, 0, &event);
                 }
                 return 1;
             }
             
         } 
 	
+	/*With --flow-map-percpu the agent loads the flow maps as per-CPU
+	 * hashes, the value is then private to this CPU and the atomics below
+	 * are uncontended. The TCP flags are or'ed without atomics, packets of
+	 * a TCP flow in one direction are rarely handled concurrently.*/
 	if (value) {
+            __u32 seen_flags = (value->tcp_flags_out | value->tcp_flags_in) & TCP_FLAG_RST;
+            value->last_seen_ns = now;
             if(dir == CGROUP_INGRESS ) {
+                seen_flags |= value->tcp_flags_out;
                 __sync_fetch_and_add(&value->out_bytes, skb->len);
                 __sync_fetch_and_add(&value->out_packets, 1);
+                if(frag) {
+                    __sync_fetch_and_add(&value->out_frag_packets, 1);
+                }
+                value->tcp_flags_out |= tcp_flags;
             } else {
+                seen_flags |= value->tcp_flags_in;
                 __sync_fetch_and_add(&value->in_bytes, skb->len);
                 __sync_fetch_and_add(&value->in_packets, 1);
+                if(frag) {
+                    __sync_fetch_and_add(&value->in_frag_packets, 1);
+                }
+                value->tcp_flags_in |= tcp_flags;
             }
+            count_tcp_flags(value, tcp_flags);
+            flow_closing(skb, seen_flags, &event);
         } 
 	return 1;
 }
@@ -169,4 +494,109 @@ SEC("cgroup_skb/egress") int bpf_egress_flow_reader(struct __sk_buff *skb) {
 	return bpf_flow_reader(skb,CGROUP_EGRESS);
 }
 
+/*Records the smoothed RTT and the retransmits of the TCP connections of
+ * the pods. RTT callbacks need kernel 5.3, older kernels only update the
+ * connection when it retransmits or changes state.*/
+SEC("sockops") int bpf_sock_ops_rtt(struct bpf_sock_ops *skops) {
+	struct rtt_key key;
+	struct rtt_stats stats = {};
+	__u32 op = skops->op;
+
+	switch (op) {
+	case BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB:
+	case BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB:
+		bpf_sock_ops_cb_flags_set(skops, BPF_SOCK_OPS_RTT_CB_FLAG |
+				BPF_SOCK_OPS_RETRANS_CB_FLAG | BPF_SOCK_OPS_STATE_CB_FLAG);
+		break;
+	case BPF_SOCK_OPS_RTT_CB:
+	case BPF_SOCK_OPS_RETRANS_CB:
+	case BPF_SOCK_OPS_STATE_CB:
+		break;
+	default:
+		return 1;
+	}
+
+	__builtin_memset(&key, 0, sizeof(key));
+	if (skops->family == AF_INET) {
+		key.family = FLOW_MAP_SEL_V4;
+		key.src_ip[0] = skops->remote_ip4;
+		key.dst_ip[0] = skops->local_ip4;
+		if (key.src_ip[0] == IPV4_LOOPBACK || key.dst_ip[0] == IPV4_LOOPBACK) {
+			return 1;
+		}
+	} else if (skops->family == AF_INET6) {
+		key.family = FLOW_MAP_SEL_V6;
+		key.src_ip[0] = skops->remote_ip6[0];
+		key.src_ip[1] = skops->remote_ip6[1];
+		key.src_ip[2] = skops->remote_ip6[2];
+		key.src_ip[3] = skops->remote_ip6[3];
+		key.dst_ip[0] = skops->local_ip6[0];
+		key.dst_ip[1] = skops->local_ip6[1];
+		key.dst_ip[2] = skops->local_ip6[2];
+		key.dst_ip[3] = skops->local_ip6[3];
+	} else {
+		return 1;
+	}
+	key.l4.ip_proto = IPPROTO_TCP;
+	key.l4.sport = bpf_htons(bpf_ntohl(skops->remote_port));
+	key.l4.dport = bpf_htons(skops->local_port);
+
+	stats.srtt_us = skops->srtt_us >> 3;
+	stats.total_retrans = skops->total_retrans;
+	stats.last_seen_ns = bpf_ktime_get_ns();
+	if (op == BPF_SOCK_OPS_STATE_CB && skops->args[1] == BPF_TCP_CLOSE) {
+		stats.closed = 1;
+	}
+	bpf_map_update_elem(&tcp_rtt_map, &key, &stats, BPF_ANY);
+	return 1;
+}
+
+/*Records the destination a socket connects or sends to, before
+ * kube-proxy translates a service address. A socket sending again to the
+ * same destination keeps the backend already recorded.*/
+static __always_inline void record_sock_svc(struct bpf_sock_addr *ctx, __u32 family)
+{
+	__u64 cookie = bpf_get_socket_cookie(ctx);
+	struct svc_dst sd;
+	struct svc_dst *old;
+
+	__builtin_memset(&sd, 0, sizeof(sd));
+	if (family == FLOW_MAP_SEL_V4) {
+		sd.svc_ip[0] = ctx->user_ip4;
+	} else {
+		sd.svc_ip[0] = ctx->user_ip6[0];
+		sd.svc_ip[1] = ctx->user_ip6[1];
+		sd.svc_ip[2] = ctx->user_ip6[2];
+		sd.svc_ip[3] = ctx->user_ip6[3];
+	}
+	sd.svc_port = (__be16)ctx->user_port;
+	old = bpf_map_lookup_elem(&sock_svc_map, &cookie);
+	if (old && old->svc_port == sd.svc_port &&
+	    old->svc_ip[0] == sd.svc_ip[0] && old->svc_ip[1] == sd.svc_ip[1] &&
+	    old->svc_ip[2] == sd.svc_ip[2] && old->svc_ip[3] == sd.svc_ip[3]) {
+		return;
+	}
+	bpf_map_update_elem(&sock_svc_map, &cookie, &sd, BPF_ANY);
+}
+
+SEC("cgroup/connect4") int bpf_connect4(struct bpf_sock_addr *ctx) {
+	record_sock_svc(ctx, FLOW_MAP_SEL_V4);
+	return 1;
+}
+
+SEC("cgroup/connect6") int bpf_connect6(struct bpf_sock_addr *ctx) {
+	record_sock_svc(ctx, FLOW_MAP_SEL_V6);
+	return 1;
+}
+
+SEC("cgroup/sendmsg4") int bpf_sendmsg4(struct bpf_sock_addr *ctx) {
+	record_sock_svc(ctx, FLOW_MAP_SEL_V4);
+	return 1;
+}
+
+SEC("cgroup/sendmsg6") int bpf_sendmsg6(struct bpf_sock_addr *ctx) {
+	record_sock_svc(ctx, FLOW_MAP_SEL_V6);
+	return 1;
+}
+
 char _license[] SEC("license") = "GPL";
@@ -3,9 +3,35 @@
 
 #include "flow.h"
 
+/*Default flow map sizes, the agent can override them and the map type at
+ * load time*/
 #define V4_FLOW_MAP_SIZE 65535
 #define V6_FLOW_MAP_SIZE 65535
 
+/*Each flow map is double buffered, flow_map_sel holds the active buffer
+ * for each address family. The agent flips it and drains the other one.*/
+#define FLOW_MAP_SEL_V4 0
+#define FLOW_MAP_SEL_V6 1
+#define FLOW_MAP_SEL_SIZE 2
+
+/*Indexes of flow_errors, the failed flow map and overflow map inserts of
+ * each family*/
+#define FLOW_ERR_V4_UPDATE 0
+#define FLOW_ERR_V6_UPDATE 1
+#define FLOW_ERR_V4_OVERFLOW 2
+#define FLOW_ERR_V6_OVERFLOW 3
+#define FLOW_ERR_SIZE 4
+
+#define OVERFLOW_MAP_SIZE 4096
+
+/*flow_counts holds the flows inserted in each buffer, at family * 2 +
+ * buffer. flow_config holds for each family the count at which a
+ * FLOW_EVENT_FILL is sent, 0 to disable, and at FLOW_CONFIG_NEW_EVENTS
+ * whether FLOW_EVENT_NEW is sent.*/
+#define FLOW_COUNTS_SIZE 4
+#define FLOW_CONFIG_NEW_EVENTS 2
+#define FLOW_CONFIG_SIZE 3
+
 struct bpf_map_def SEC("maps") v4_flow_map = {
     .type = BPF_MAP_TYPE_HASH,
     .key_size = sizeof(struct inet_v4_flow),
@@ -15,6 +41,15 @@ struct bpf_map_def SEC("maps") v4_flow_map = {
 
 BPF_ANNOTATE_KV_PAIR(v4_flow_map, struct inet_v4_flow, struct flow_stats);
 
+struct bpf_map_def SEC("maps") v4_flow_map_1 = {
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(struct inet_v4_flow),
+    .value_size = sizeof(struct flow_stats),
+    .max_entries = V4_FLOW_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(v4_flow_map_1, struct inet_v4_flow, struct flow_stats);
+
 struct bpf_map_def SEC("maps") v6_flow_map = {
     .type = BPF_MAP_TYPE_HASH,
     .key_size = sizeof(struct inet_v6_flow),
@@ -24,4 +59,109 @@ struct bpf_map_def SEC("maps") v6_flow_map = {
 
 BPF_ANNOTATE_KV_PAIR(v6_flow_map, struct inet_v6_flow, struct flow_stats);
 
+struct bpf_map_def SEC("maps") v6_flow_map_1 = {
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(struct inet_v6_flow),
+    .value_size = sizeof(struct flow_stats),
+    .max_entries = V6_FLOW_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(v6_flow_map_1, struct inet_v6_flow, struct flow_stats);
+
+struct bpf_map_def SEC("maps") flow_map_sel = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u32),
+    .max_entries = FLOW_MAP_SEL_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(flow_map_sel, __u32, __u32);
+
+struct bpf_map_def SEC("maps") flow_errors = {
+    .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .max_entries = FLOW_ERR_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(flow_errors, __u32, __u64);
+
+struct bpf_map_def SEC("maps") flow_overflow_map = {
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(struct overflow_key),
+    .value_size = sizeof(struct flow_stats),
+    .max_entries = OVERFLOW_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(flow_overflow_map, struct overflow_key, struct flow_stats);
+
+struct bpf_map_def SEC("maps") flow_counts = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .max_entries = FLOW_COUNTS_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(flow_counts, __u32, __u64);
+
+struct bpf_map_def SEC("maps") flow_config = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .max_entries = FLOW_CONFIG_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(flow_config, __u32, __u64);
+
+#define RTT_MAP_SIZE 65535
+
+struct bpf_map_def SEC("maps") tcp_rtt_map = {
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(struct rtt_key),
+    .value_size = sizeof(struct rtt_stats),
+    .max_entries = RTT_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(tcp_rtt_map, struct rtt_key, struct rtt_stats);
+
+#define SOCK_SVC_MAP_SIZE 65535
+
+/*Original destination of each socket, by socket cookie*/
+struct bpf_map_def SEC("maps") sock_svc_map = {
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(__u64),
+    .value_size = sizeof(struct svc_dst),
+    .max_entries = SOCK_SVC_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(sock_svc_map, __u64, struct svc_dst);
+
+/*Original destination of the socket of each flow, recorded when the flow
+ * is inserted in a flow map buffer*/
+struct bpf_map_def SEC("maps") v4_flow_svc_map = {
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(struct inet_v4_flow),
+    .value_size = sizeof(struct svc_dst),
+    .max_entries = V4_FLOW_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(v4_flow_svc_map, struct inet_v4_flow, struct svc_dst);
+
+struct bpf_map_def SEC("maps") v6_flow_svc_map = {
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(struct inet_v6_flow),
+    .value_size = sizeof(struct svc_dst),
+    .max_entries = V6_FLOW_MAP_SIZE,
+};
+
+BPF_ANNOTATE_KV_PAIR(v6_flow_svc_map, struct inet_v6_flow, struct svc_dst);
+
+/*Sizes are set by the agent, one entry per CPU*/
+struct bpf_map_def SEC("maps") flow_events = {
+    .type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+    .key_size = 0,
+    .value_size = 0,
+    .max_entries = 0,
+};
+
 #endif /*__EBPF_MAPS_H*/
@@ -8,9 +8,34 @@ enum cgroup_direction {
 
 #define IPPROTO_UDP 17
 #define IPPROTO_TCP 6
+#define IPPROTO_ICMP 1
+#define IPPROTO_ICMPV6 58
+#define IPPROTO_SCTP 132
 #define IPV4_LOOPBACK 0x0100007f
 
-/*Golang libraries assume 4 byte multiples for keysize*/
+/*Fragment offset and more fragments flags of the IPv4 header, and fragment
+ * offset of the IPv6 fragment header*/
+#define IP_MF 0x2000
+#define IP_OFFSET 0x1FFF
+#define IPV6_FRAG_OFFSET 0xFFF8
+
+/*IPv6 extension headers skipped to find the L4 header*/
+#define IPPROTO_HOPOPTS 0
+#define IPPROTO_ROUTING 43
+#define IPPROTO_FRAGMENT 44
+#define IPPROTO_AH 51
+#define IPPROTO_DSTOPTS 60
+#define IPV6_EXT_MAX 6
+
+/*TCP flags, as in byte 13 of the TCP header*/
+#define TCP_FLAG_FIN 0x01
+#define TCP_FLAG_SYN 0x02
+#define TCP_FLAG_RST 0x04
+#define TCP_FLAG_ACK 0x10
+
+/*Golang libraries assume 4 byte multiples for keysize. ICMP and ICMPv6
+ * flows carry the type in sport and the code in dport, in network order
+ * like ports, whatever the direction.*/
 struct proto_port {
     __u8 ip_proto;
     __u8 padding[3];
@@ -24,11 +49,96 @@ struct inet_v4_flow {
     struct proto_port l4;
 } ;
 
+/*first/last_seen_ns are bpf_ktime_get_ns timestamps. tcp_flags_out/in
+ * are the TCP flags seen in each direction, named like the counters.
+ * syn_count counts SYNs without ACK, syn_ack_count SYN-ACKs, both
+ * directions together. out/in_frag_packets count the IP fragments among
+ * the packets.*/
 struct flow_stats {
     __u64 out_bytes;
     __u64 out_packets;
     __u64 in_bytes;
     __u64 in_packets;
+    __u64 first_seen_ns;
+    __u64 last_seen_ns;
+    __u32 tcp_flags_out;
+    __u32 tcp_flags_in;
+    __u64 syn_count;
+    __u64 syn_ack_count;
+    __u64 fin_count;
+    __u64 rst_count;
+    __u64 out_frag_packets;
+    __u64 in_frag_packets;
+};
+
+/*Packets of flows that could not be inserted in a full flow map are
+ * accounted to the cgroup of their socket. family is FLOW_MAP_SEL_V4 or
+ * FLOW_MAP_SEL_V6.*/
+struct overflow_key {
+    __u64 cgroup_id;
+    __u32 family;
+    __u32 padding;
+};
+
+/*Events sent to the agent over flow_events. Addresses and ports are those
+ * of the normalized flow key, v4 addresses only use src_ip[0] and
+ * dst_ip[0]. buffer is the flow map buffer holding the flow and
+ * tcp_flags those of the packet that caused the event.
+ * FLOW_EVENT_NEW is only sent when enabled in flow_config, for TCP flows
+ * inserted by a SYN without ACK and other flows missing from the other
+ * buffer.
+ * FLOW_EVENT_CLOSE is sent for the first FIN of each direction and the
+ * first RST of a TCP flow in a buffer.*/
+#define FLOW_EVENT_NEW 1
+#define FLOW_EVENT_FILL 2
+#define FLOW_EVENT_CLOSE 3
+
+struct flow_event {
+    __u32 type;
+    __u32 family;
+    __be32 src_ip[4];
+    __be32 dst_ip[4];
+    struct proto_port l4;
+    __u32 buffer;
+    __u32 tcp_flags;
+};
+
+#ifndef AF_INET
+#define AF_INET 2
+#endif
+#ifndef AF_INET6
+#define AF_INET6 10
+#endif
+
+/*TCP connections seen by the sockops program, keyed like the flows with
+ * the remote end as source and the pod as destination. family is
+ * FLOW_MAP_SEL_V4 or FLOW_MAP_SEL_V6, v4 addresses only use src_ip[0] and
+ * dst_ip[0].*/
+struct rtt_key {
+    __u32 family;
+    __be32 src_ip[4];
+    __be32 dst_ip[4];
+    struct proto_port l4;
+};
+
+/*srtt_us is the smoothed RTT in microseconds, total_retrans the segments
+ * retransmitted by the pod and closed is set once the socket is closed*/
+struct rtt_stats {
+    __u32 srtt_us;
+    __u32 total_retrans;
+    __u64 last_seen_ns;
+    __u32 closed;
+    __u32 padding;
+};
+
+/*Destination a socket connected or sent to before kube-proxy translated
+ * it, recorded by the connect and sendmsg programs. backend_ip is the
+ * translated destination once an egress packet of the socket was seen.*/
+struct svc_dst {
+    __be32 svc_ip[4];
+    __be32 backend_ip[4];
+    __be16 svc_port;
+    __u16 padding;
 };
 
 struct inet_v6_flow {
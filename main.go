@@ -18,7 +18,9 @@ import (
 	"flag"
 	"github.com/shastrinator/kubpf/pkg/statsagent"
 	"github.com/sirupsen/logrus"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -31,13 +33,31 @@ func main() {
 		panic(err.Error())
 	}
 	log.Level = logLevel
-	var env statsagent.Environment
-	env, err = statsagent.NewK8sEnvironment(conf, log)
-	if err != nil {
+	env, err := statsagent.NewK8sEnvironment(conf, log)
+	if env == nil {
 		panic(err.Error())
 	}
 	agent := statsagent.NewStatsAgent(conf, log, env)
-	agent.Init()
-	agent.Run(wait.NeverStop)
-	agent.RunStatus()
+	stopCh := make(chan struct{})
+	if err == nil {
+		agent.Init()
+		agent.Run(stopCh)
+	} else {
+		// Without its bpf programs the agent only serves the status,
+		// which reports the failure, until it is stopped
+		log.Error("Not starting, bpf object failed to load: ", err)
+		env.InitStatus(agent)
+	}
+	go agent.RunStatus()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	log.Info("Received ", sig, ", shutting down")
+	close(stopCh)
+	if err == nil {
+		agent.Stop()
+	} else {
+		agent.StopStatus()
+	}
 }
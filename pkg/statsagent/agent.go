@@ -16,33 +16,77 @@ package statsagent
 
 import (
 	"flag"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
+// PodIPs holds every address of the pod, two of them on dual-stack
+// clusters
 type PodInfo struct {
-	PodIP string
+	PodIPs []string
 }
 
+// ClusterIPs holds the cluster addresses of the service, ExternalPorts
+// and LoadBalancerPorts the svcPortKeys of its external and load balancer
+// addresses and NodePorts the nodePortKeys it is reachable at on every
+// node
 type SvcInfo struct {
-	ClusterIP string
-	SvcType   string
+	ClusterIPs        []string
+	ExternalPorts     []string
+	LoadBalancerPorts []string
+	NodePorts         []string
+	SvcType           string
 }
 
+// Ways a service is accessed, the svc_access label
+const (
+	SvcAccessClusterIP    = "cluster_ip"
+	SvcAccessExternalIP   = "external_ip"
+	SvcAccessLoadBalancer = "load_balancer"
+	SvcAccessNodePort     = "node_port"
+)
+
+// Sides of the service connections of a pod, the svc_side label
+const (
+	SvcSideClient  = "client"
+	SvcSideBackend = "backend"
+)
+
 type StatsAgent struct {
 	config         *StatsAgentConfig
 	log            *logrus.Logger
 	env            Environment
 	podInformer    cache.SharedIndexInformer
 	svcInformer    cache.SharedIndexInformer
+	sliceInformer  cache.SharedIndexInformer
+	nodeInformer   cache.SharedIndexInformer
 	podInfo        map[string]PodInfo
 	podIpToName    map[string]string
 	svcInfo        map[string]SvcInfo
 	svcIpToName    map[string]string
+	svcPortToSvc   map[string]string
+	svcPortAccess  map[string]string
+	nodePortToSvc  map[string]string
+	nodeInfo       map[string][]string
+	nodeIpToName   map[string]string
+	backendToSvc   map[string]string
+	sliceInfo      map[string]EndpointSliceInfo
+	podUidToName   map[string]string
+	warnings       map[string]string
 	stateMutex     sync.Mutex
+	cgroupPodUid   map[uint64]string
+	cgroupWalkTime time.Time
+	cgroupMutex    sync.Mutex
 	metrics        map[string]MetricsEntry
 	promSubsystems map[string]PromSubsystemEntry
+	flowMapOpener  FlowMapOpener
+	bpfLoader      *BpfLoader
+	statusServer   *http.Server
 }
 
 type StatsAgentConfig struct {
@@ -58,23 +102,92 @@ type StatsAgentConfig struct {
 	// Path to which ebpf maps should be pinned, some where in /sys/fs/bpf
 	EbpfMapDir string `json:"ebpf-map-dir,omitempty"`
 
+	// Path to which ebpf programs should be pinned, some where in /sys/fs/bpf
+	EbpfProgDir string `json:"ebpf-prog-dir,omitempty"`
+
+	// Object file with the ebpf programs and maps to load
+	BpfObject string `json:"bpf-object,omitempty"`
+
+	// Count flows in per-CPU hash maps, avoiding atomic operations shared
+	// between CPUs at the cost of summing the values when reading
+	FlowMapPerCPU bool `json:"flow-map-percpu,omitempty"`
+
+	// Type of the flow maps: hash, or lru to evict the least recently
+	// used flows instead of dropping inserts when full
+	FlowMapType string `json:"flow-map-type,omitempty"`
+
+	// Capacity of each IPv4 and IPv6 flow map buffer (or 0 for the size
+	// in the bpf object)
+	V4FlowMapSize int `json:"v4-flow-map-size,omitempty"`
+	V6FlowMapSize int `json:"v6-flow-map-size,omitempty"`
+
 	// Cgroup root for kubernetes
 	CgroupRoot string `json:"cgroup-root,omitempty"`
 
-	// Interval in which stats should be scanned
-	StatsInterval int `json: stats-interval in seconds,omitempty`
+	// Interval in which stats should be scanned, the longest interval when
+	// it adapts to the flow map fill level
+	StatsInterval int `json:"stats-interval,omitempty"`
+
+	// Shortest interval in which stats are scanned when flow maps fill up
+	MinStatsInterval int `json:"min-stats-interval,omitempty"`
+
+	// Time in seconds without traffic after which a flow is forgotten
+	FlowIdleTimeout int `json:"flow-idle-timeout,omitempty"`
+
+	// Have the kernel send an event for every new connection, to export
+	// the rate of new connections per pod
+	FlowNewEvents bool `json:"flow-new-events,omitempty"`
 
 	// TCP port to run status server on (or 0 to disable)
 	StatusPort int `json:"status-port,omitempty"`
+
+	// What to clean up on shutdown: none, detach or remove
+	CleanupMode string `json:"cleanup-mode,omitempty"`
+
+	// Directory in which flow state is saved across restarts (or empty
+	// to disable), dedicated to the agent
+	StateDir string `json:"state-dir,omitempty"`
+
+	// How flows to translated service addresses are tied to their
+	// service: socket (cgroup connect hooks) or conntrack
+	ServiceResolution string `json:"service-resolution,omitempty"`
+
+	// Label the series of backend pods with their client pods, which
+	// makes one series per client of every backend
+	BackendClientLabels bool `json:"backend-client-labels,omitempty"`
 }
 
 func (config *StatsAgentConfig) InitFlags() {
 	flag.StringVar(&config.LogLevel, "log-level", "debug", "Log level")
 	flag.StringVar(&config.EbpfMapDir, "ebpf-map-dir", "/sys/fs/bpf/pinned_maps", "Path to which ebpf maps should be pinned")
+	flag.StringVar(&config.EbpfProgDir, "ebpf-prog-dir", "/sys/fs/bpf/prog", "Path to which ebpf programs should be pinned")
+	flag.StringVar(&config.BpfObject, "bpf-object", "/bin/bpf_cgroup_kern.o", "Object file with the ebpf programs and maps to load")
+	flag.BoolVar(&config.FlowMapPerCPU, "flow-map-percpu", false, "Count flows in per-CPU hash maps")
+	flag.StringVar(&config.FlowMapType, "flow-map-type", FlowMapTypeHash, "Type of the flow maps: hash or lru")
+	flag.IntVar(&config.V4FlowMapSize, "v4-flow-map-size", 0, "Capacity of each IPv4 flow map buffer (or 0 for the size in the bpf object)")
+	flag.IntVar(&config.V6FlowMapSize, "v6-flow-map-size", 0, "Capacity of each IPv6 flow map buffer (or 0 for the size in the bpf object)")
 	flag.StringVar(&config.CgroupRoot, "cgroup-root", "/sys/fs/cgroup/unified/kubepods.slice", "Cgroup root for monitored instance of kubernetes")
 	flag.StringVar(&config.NodeName, "node-name", "", "Name of Kubernetes node on which this agent is running")
 	flag.IntVar(&config.StatusPort, "status-port", 8010, "TCP port to run status server on (or 0 to disable)")
 	flag.IntVar(&config.StatsInterval, "stats-interval", 120, "Time in seconds between stats collection runs")
+	flag.IntVar(&config.MinStatsInterval, "min-stats-interval", 15, "Shortest time in seconds between stats collection runs when flow maps fill up")
+	flag.IntVar(&config.FlowIdleTimeout, "flow-idle-timeout", 300, "Time in seconds without traffic after which a flow is forgotten")
+	flag.BoolVar(&config.FlowNewEvents, "flow-new-events", false, "Send an event for every new connection to export the rate of new connections per pod")
+	flag.StringVar(&config.CleanupMode, "cleanup-mode", CleanupDetach,
+		"On shutdown: none (leave programs attached), detach (detach programs, keep pinned maps) or remove (detach programs and remove pinned maps)")
+	flag.StringVar(&config.StateDir, "state-dir", "/var/lib/statsagent", "Directory in which flow state is saved across restarts (or empty to disable)")
+	flag.StringVar(&config.ServiceResolution, "service-resolution", ServiceResolutionSocket,
+		"How flows to translated service addresses are resolved: socket (cgroup connect hooks) or conntrack (netlink dump, without socket hooks)")
+	flag.BoolVar(&config.BackendClientLabels, "backend-client-labels", false, "Label the service stats of backend pods with their client pods")
+}
+
+// statsIntervalBounds returns the range the scan interval adapts in, a
+// minimum of 0 or above the interval disables adapting
+func (config *StatsAgentConfig) statsIntervalBounds() (int, int) {
+	if config.MinStatsInterval <= 0 || config.MinStatsInterval > config.StatsInterval {
+		return config.StatsInterval, config.StatsInterval
+	}
+	return config.MinStatsInterval, config.StatsInterval
 }
 
 func NewStatsAgent(config *StatsAgentConfig, logger *logrus.Logger, env Environment) *StatsAgent {
@@ -87,12 +200,30 @@ func NewStatsAgent(config *StatsAgentConfig, logger *logrus.Logger, env Environm
 		podIpToName:    make(map[string]string),
 		svcInfo:        make(map[string]SvcInfo),
 		svcIpToName:    make(map[string]string),
+		svcPortToSvc:   make(map[string]string),
+		svcPortAccess:  make(map[string]string),
+		nodePortToSvc:  make(map[string]string),
+		nodeInfo:       make(map[string][]string),
+		nodeIpToName:   make(map[string]string),
+		backendToSvc:   make(map[string]string),
+		sliceInfo:      make(map[string]EndpointSliceInfo),
+		podUidToName:   make(map[string]string),
+		warnings:       make(map[string]string),
+		cgroupPodUid:   make(map[uint64]string),
 		metrics:        make(map[string]MetricsEntry),
 		promSubsystems: make(map[string]PromSubsystemEntry),
+		flowMapOpener:  NewPinnedFlowMapOpener(config),
+		statusServer:   &http.Server{Addr: fmt.Sprintf(":%d", config.StatusPort)},
 	}
 	return statsAgent
 }
 
+// SetFlowMapOpener replaces the pinned ebpf maps read by the flow metrics,
+// for instance with a MemFlowMapSet
+func (agent *StatsAgent) SetFlowMapOpener(opener FlowMapOpener) {
+	agent.flowMapOpener = opener
+}
+
 func (agent *StatsAgent) Init() {
 	err := agent.env.Init(agent)
 	if err != nil {
@@ -109,3 +240,90 @@ func (agent *StatsAgent) Run(stopCh <-chan struct{}) {
 		<-stopCh
 	}()
 }
+
+// setWarning reports a condition in the status until it is cleared by
+// setting an empty message for the same key
+func (agent *StatsAgent) setWarning(key string, message string) {
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	if message == "" {
+		delete(agent.warnings, key)
+	} else {
+		agent.warnings[key] = message
+	}
+}
+
+// getWarnings returns the current warnings sorted by key, the caller holds
+// stateMutex
+func (agent *StatsAgent) getWarnings() []string {
+	var keys []string
+	for k := range agent.warnings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var warnings []string
+	for _, k := range keys {
+		warnings = append(warnings, agent.warnings[k])
+	}
+	return warnings
+}
+
+// Stop flushes the stats collected since the last scan and cleans up the
+// environment. It is called once the stopCh passed to Run is closed.
+func (agent *StatsAgent) Stop() {
+	for name, m := range agent.metrics {
+		agent.log.Debug("Final stats flush for ", name)
+		m.UpdateStats()
+	}
+	err := agent.env.Cleanup()
+	if err != nil {
+		agent.log.Error("Failed to clean up: ", err)
+	}
+	if agent.config.CleanupMode == CleanupRemove {
+		agent.removeStates()
+	}
+	agent.StopStatus()
+}
+
+// removeIPs removes the addresses of oldIPs missing from newIPs from
+// ipToName, unless they now belong to another object. Called with
+// stateMutex held.
+func removeIPs(ipToName map[string]string, key string, oldIPs []string, newIPs []string) {
+	for _, oldIP := range oldIPs {
+		found := false
+		for _, newIP := range newIPs {
+			if oldIP == newIP {
+				found = true
+				break
+			}
+		}
+		if !found && ipToName[oldIP] == key {
+			delete(ipToName, oldIP)
+		}
+	}
+}
+
+// resolveSvc returns the endpoint of the service reached at ip and port,
+// a protocol name and port number from a flow key. Called with stateMutex
+// held, or from the scans like getPodStatsKey.
+func (agent *StatsAgent) resolveSvc(ip string, proto string, port string) (string, bool) {
+	if svcName, ok := agent.svcIpToName[ip]; ok {
+		return svcEndpoint(svcName, agent.svcInfo[svcName].SvcType, SvcAccessClusterIP), true
+	}
+	key := svcPortKey(proto, ip, port)
+	if svcName, ok := agent.svcPortToSvc[key]; ok {
+		return svcEndpoint(svcName, agent.svcInfo[svcName].SvcType, agent.svcPortAccess[key]), true
+	}
+	if _, ok := agent.nodeIpToName[ip]; ok {
+		if svcName, ok := agent.nodePortToSvc[nodePortKey(proto, port)]; ok {
+			return svcEndpoint(svcName, agent.svcInfo[svcName].SvcType, SvcAccessNodePort), true
+		}
+	}
+	return "", false
+}
+
+// svcEndpoint formats a service endpoint of a PodStatsKey, access is empty
+// when the way the service was reached is unknown
+func svcEndpoint(svcName string, svcType string, access string) string {
+	return svcName + "/" + svcType + "/" + access
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AgentStats Prometheus Entries, about the agent itself
+var AgentPromMetrics = [...]string{
+	"scan_duration_seconds",
+	"scan_entries",
+	"flow_map_fill_ratio",
+	"flow_insert_drops",
+	"overflow_insert_drops",
+	"flow_map_info",
+	"scan_interval_seconds",
+	"flow_events_lost",
+}
+
+var AgentPromHelp = [...]string{
+	"duration of the last flow map scan",
+	"flow map entries read in the last scan",
+	"ratio of the flow map capacity used at the last scan",
+	"flow map inserts dropped because the map was full",
+	"overflow map inserts dropped because the map was full",
+	"type and capacity of the flow maps, always 1",
+	"interval until the next flow map scan",
+	"flow events dropped because the event buffers were full",
+}
+
+var flowMapPromLabels = []string{"map_name", "ip_family"}
+
+var AgentPromLabels = [...][]string{
+	flowMapPromLabels,
+	flowMapPromLabels,
+	flowMapPromLabels,
+	flowMapPromLabels,
+	flowMapPromLabels,
+	{"map_name", "ip_family", "map_type", "max_entries"},
+	flowMapPromLabels,
+	{},
+}
+
+type AgentPromSubsystemEntry struct {
+	*PromSubsystem
+}
+
+func (agent *StatsAgent) SetScanGauges(mapName string, ipFamily string, duration time.Duration, entries int) {
+	labels := prometheus.Labels{
+		"map_name":  mapName,
+		"ip_family": ipFamily,
+	}
+	subsystem := agent.promSubsystems["agent"]
+	subsystem.GetGaugeVec("scan_duration_seconds").With(labels).Set(duration.Seconds())
+	subsystem.GetGaugeVec("scan_entries").With(labels).Set(float64(entries))
+}
+
+func (agent *StatsAgent) SetMapPressureGauges(mapName string, ipFamily string, fillRatio float64,
+	drops uint64, overflowDrops uint64) {
+	labels := prometheus.Labels{
+		"map_name":  mapName,
+		"ip_family": ipFamily,
+	}
+	subsystem := agent.promSubsystems["agent"]
+	subsystem.GetGaugeVec("flow_map_fill_ratio").With(labels).Set(fillRatio)
+	subsystem.GetGaugeVec("flow_insert_drops").With(labels).Set(float64(drops))
+	subsystem.GetGaugeVec("overflow_insert_drops").With(labels).Set(float64(overflowDrops))
+}
+
+func (agent *StatsAgent) SetScanIntervalGauge(mapName string, ipFamily string, interval int) {
+	agent.promSubsystems["agent"].GetGaugeVec("scan_interval_seconds").With(prometheus.Labels{
+		"map_name":  mapName,
+		"ip_family": ipFamily,
+	}).Set(float64(interval))
+}
+
+func (agent *StatsAgent) SetFlowEventsLostGauge(lost uint64) {
+	agent.promSubsystems["agent"].GetGaugeVec("flow_events_lost").With(prometheus.Labels{}).Set(float64(lost))
+}
+
+func (agent *StatsAgent) SetFlowMapInfo(mapName string, mapType string, maxEntries uint32) {
+	ipFamily := "ipv4"
+	if strings.HasPrefix(mapName, "v6_") {
+		ipFamily = "ipv6"
+	}
+	agent.promSubsystems["agent"].GetGaugeVec("flow_map_info").With(prometheus.Labels{
+		"map_name":    mapName,
+		"ip_family":   ipFamily,
+		"map_type":    mapType,
+		"max_entries": strconv.FormatUint(uint64(maxEntries), 10),
+	}).Set(1)
+}
+
+func (entry *AgentPromSubsystemEntry) SubsystemName() string {
+	return entry.Subsystem
+}
+
+func (entry *AgentPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
+	for i, metricName := range AgentPromMetrics {
+		gauge :=
+			prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "statsagent",
+				Subsystem: "agent",
+				Name:      metricName,
+				Help:      AgentPromHelp[i],
+			}, AgentPromLabels[i])
+		entry.Gauges[metricName] = &PromGauge{
+			Name:  metricName,
+			Cache: gauge,
+		}
+		err := prometheus.Register(gauge)
+		if err != nil {
+			agent.log.Error("Failed to register ", metricName, " with Prometheus: ", err)
+		} else {
+			agent.log.Debug("Registered ", metricName, " with Prometheus: ")
+		}
+	}
+}
+
+func (entry *AgentPromSubsystemEntry) GetGaugeVec(metricName string) *prometheus.GaugeVec {
+	return entry.Gauges[metricName].Cache
+}
+
+func NewAgentPromSubsystemEntry() PromSubsystemEntry {
+	promSubsystem := &PromSubsystem{
+		Subsystem: "agent",
+		Gauges:    make(map[string]*PromGauge),
+	}
+
+	return &AgentPromSubsystemEntry{
+		PromSubsystem: promSubsystem,
+	}
+}
@@ -0,0 +1,614 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Stages of loading and attaching the bpf object, reported in BpfLoaderError
+const (
+	StageLoadSpec    = "load-spec"
+	StageCreateMap   = "create-map"
+	StagePinMap      = "pin-map"
+	StageLoadProgram = "load-program"
+	StagePinProgram  = "pin-program"
+	StageOpenCgroup  = "open-cgroup"
+	StageAttach      = "attach"
+	StageDetach      = "detach"
+)
+
+// BPF_F_ALLOW_MULTI, lets other agents attach to the same cgroup
+const bpfFAllowMulti ebpf.AttachFlags = 2
+
+// BpfLoaderError records the stage and object for which loading failed
+type BpfLoaderError struct {
+	Stage  string
+	Object string
+	Err    error
+}
+
+func (e *BpfLoaderError) Error() string {
+	return fmt.Sprintf("bpf %s %s: %v", e.Stage, e.Object, e.Err)
+}
+
+// cgroupProgram is a program of the bpf object attached to the cgroup
+// root. PinName matches the name bpftool used to pin it. The agent runs
+// without an Optional program that fails to load or attach. Services are
+// resolved from conntrack when a socket address program fails, see
+// fallBackToConntrack.
+type cgroupProgram struct {
+	PinName    string
+	Type       ebpf.ProgramType
+	AttachType ebpf.AttachType
+	Optional   bool
+}
+
+// The sockops program only feeds the RTT metrics
+const sockOpsPinName = "cgroup_sock_ops"
+
+var cgroupPrograms = []cgroupProgram{
+	{"cgroup_skb_ingress", ebpf.CGroupSKB, ebpf.AttachCGroupInetIngress, false},
+	{"cgroup_skb_egress", ebpf.CGroupSKB, ebpf.AttachCGroupInetEgress, false},
+	{sockOpsPinName, ebpf.SockOps, ebpf.AttachCGroupSockOps, true},
+	{"cgroup_connect4", ebpf.CGroupSockAddr, ebpf.AttachCGroupInet4Connect, true},
+	{"cgroup_connect6", ebpf.CGroupSockAddr, ebpf.AttachCGroupInet6Connect, true},
+	{"cgroup_sendmsg4", ebpf.CGroupSockAddr, ebpf.AttachCGroupUDP4Sendmsg, true},
+	{"cgroup_sendmsg6", ebpf.CGroupSockAddr, ebpf.AttachCGroupUDP6Sendmsg, true},
+}
+
+// Flow maps of the bpf object, their type can be changed at load time
+var flowMapNames = []string{
+	"v4_flow_map", "v4_flow_map_1", "v6_flow_map", "v6_flow_map_1",
+}
+
+type bpfLoaderErrorStatus struct {
+	Stage  string `json:"stage,omitempty"`
+	Object string `json:"object,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BpfStatus struct {
+	Object   string                 `json:"object,omitempty"`
+	Maps     []string               `json:"maps,omitempty"`
+	Attached []string               `json:"attached,omitempty"`
+	Warnings []bpfLoaderErrorStatus `json:"warnings,omitempty"`
+	Error    *bpfLoaderErrorStatus  `json:"error,omitempty"`
+}
+
+// BpfLoader loads the bpf object, pins its maps and programs and attaches
+// the programs to the kubernetes cgroup root.
+type BpfLoader struct {
+	config     *StatsAgentConfig
+	log        *logrus.Logger
+	maps       map[string]*ebpf.Map
+	reused     map[string]bool
+	programs   map[string]*ebpf.Program
+	cgroup     *os.File
+	status     BpfStatus
+	stateMutex sync.Mutex
+	// Whether cgroup_skb programs may call bpf_skb_cgroup_id
+	skbCgroupID bool
+}
+
+func NewBpfLoader(config *StatsAgentConfig, log *logrus.Logger) *BpfLoader {
+	return &BpfLoader{
+		config:   config,
+		log:      log,
+		maps:     make(map[string]*ebpf.Map),
+		reused:   make(map[string]bool),
+		programs: make(map[string]*ebpf.Program),
+		status:   BpfStatus{Object: config.BpfObject},
+	}
+}
+
+func toErrorStatus(err *BpfLoaderError) bpfLoaderErrorStatus {
+	return bpfLoaderErrorStatus{
+		Stage:  err.Stage,
+		Object: err.Object,
+		Error:  err.Err.Error(),
+	}
+}
+
+// fail records err as the reason loading stopped and returns it
+func (loader *BpfLoader) fail(stage string, object string, err error) error {
+	loaderErr := &BpfLoaderError{Stage: stage, Object: object, Err: err}
+	loader.stateMutex.Lock()
+	defer loader.stateMutex.Unlock()
+	errStatus := toErrorStatus(loaderErr)
+	loader.status.Error = &errStatus
+	return loaderErr
+}
+
+// warn records a failure that does not prevent the agent from running
+func (loader *BpfLoader) warn(stage string, object string, err error) {
+	loaderErr := &BpfLoaderError{Stage: stage, Object: object, Err: err}
+	loader.log.Warn(loaderErr.Error())
+	loader.stateMutex.Lock()
+	defer loader.stateMutex.Unlock()
+	loader.status.Warnings = append(loader.status.Warnings, toErrorStatus(loaderErr))
+}
+
+// demote turns the failure recorded by fail into a warning, once the
+// agent decided to run without the object that failed
+func (loader *BpfLoader) demote() {
+	loader.stateMutex.Lock()
+	defer loader.stateMutex.Unlock()
+	if loader.status.Error == nil {
+		return
+	}
+	errStatus := *loader.status.Error
+	loader.log.Warn("bpf ", errStatus.Stage, " ", errStatus.Object, ": ", errStatus.Error)
+	loader.status.Warnings = append(loader.status.Warnings, errStatus)
+	loader.status.Error = nil
+}
+
+func (loader *BpfLoader) GetStatus() BpfStatus {
+	loader.stateMutex.Lock()
+	defer loader.stateMutex.Unlock()
+	return loader.status
+}
+
+// loadMap reuses a map already pinned by a previous run of the agent so
+// that flow counters survive restarts. A pinned map whose layout no
+// longer matches the object is replaced. Perf event arrays are always
+// replaced, the buffers they point to belong to the agent that created
+// them.
+func (loader *BpfLoader) loadMap(name string, spec *ebpf.MapSpec) (*ebpf.Map, error) {
+	path := filepath.Join(loader.config.EbpfMapDir, name)
+	if _, err := os.Stat(path); err == nil {
+		if spec.Type != ebpf.PerfEventArray {
+			m, err := ebpf.LoadPinnedMap(path)
+			if err == nil {
+				abi := ebpf.MapABI{
+					Type:       spec.Type,
+					KeySize:    spec.KeySize,
+					ValueSize:  spec.ValueSize,
+					MaxEntries: spec.MaxEntries,
+				}
+				err = abi.Check(m)
+				if err == nil {
+					loader.log.Debug("Reusing pinned map ", path)
+					loader.reused[name] = true
+					return m, nil
+				}
+				m.Close()
+			}
+			loader.warn(StagePinMap, name, fmt.Errorf("replacing pinned map: %v", err))
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, loader.fail(StagePinMap, name, err)
+		}
+	}
+	spec = spec.Copy()
+	spec.Name = name
+	m, err := ebpf.NewMap(spec)
+	if err != nil {
+		return nil, loader.fail(StageCreateMap, name, err)
+	}
+	if err = m.Pin(path); err != nil {
+		m.Close()
+		return nil, loader.fail(StagePinMap, name, err)
+	}
+	loader.log.Debug("Pinned map ", path)
+	return m, nil
+}
+
+// Map returns the named map of the bpf object, or nil if it is not loaded
+func (loader *BpfLoader) Map(name string) *ebpf.Map {
+	return loader.maps[name]
+}
+
+// Attached reports whether the program pinned as pinName is attached to
+// the cgroup root
+func (loader *BpfLoader) Attached(pinName string) bool {
+	loader.stateMutex.Lock()
+	defer loader.stateMutex.Unlock()
+	for _, name := range loader.status.Attached {
+		if name == pinName {
+			return true
+		}
+	}
+	return false
+}
+
+// MapReused reports whether the named map was left pinned by a previous
+// run of the agent, and so still holds the counters it has seen.
+func (loader *BpfLoader) MapReused(name string) bool {
+	return loader.reused[name]
+}
+
+// Flow map types selected with --flow-map-type
+const (
+	FlowMapTypeHash = "hash"
+	FlowMapTypeLRU  = "lru"
+)
+
+// flowMapSpec applies the configured flow map type and size to spec
+func (loader *BpfLoader) flowMapSpec(name string, spec *ebpf.MapSpec) *ebpf.MapSpec {
+	isFlowMap := false
+	for _, flowMapName := range flowMapNames {
+		if name == flowMapName {
+			isFlowMap = true
+		}
+	}
+	if !isFlowMap {
+		return spec
+	}
+	spec = spec.Copy()
+	lru := loader.config.FlowMapType == FlowMapTypeLRU
+	switch {
+	case lru && loader.config.FlowMapPerCPU:
+		spec.Type = ebpf.LRUCPUHash
+	case lru:
+		spec.Type = ebpf.LRUHash
+	case loader.config.FlowMapPerCPU:
+		spec.Type = ebpf.PerCPUHash
+	}
+	size := loader.config.V4FlowMapSize
+	if strings.HasPrefix(name, "v6_") {
+		size = loader.config.V6FlowMapSize
+	}
+	if size > 0 {
+		spec.MaxEntries = uint32(size)
+	}
+	return spec
+}
+
+// FlowMapABIs returns the type and size of the loaded flow maps
+func (loader *BpfLoader) FlowMapABIs() map[string]ebpf.MapABI {
+	abis := make(map[string]ebpf.MapABI)
+	for _, name := range flowMapNames {
+		if m, ok := loader.maps[name]; ok {
+			abis[name] = m.ABI()
+		}
+	}
+	return abis
+}
+
+// probeSkbCgroupID reports whether the kernel lets cgroup_skb programs
+// call bpf_skb_cgroup_id, which only the overflow accounting needs
+func probeSkbCgroupID() bool {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.CGroupSKB,
+		Instructions: asm.Instructions{
+			asm.FnSkbCgroupId.Call(),
+			asm.Mov.Imm(asm.R0, 1),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	if err != nil {
+		return false
+	}
+	prog.Close()
+	return true
+}
+
+func (loader *BpfLoader) loadProgram(spec *ebpf.ProgramSpec) (*ebpf.Program, error) {
+	spec = spec.Copy()
+	for i := range spec.Instructions {
+		ins := &spec.Instructions[i]
+		// Without the helper the cgroup id reads as 0, for which the
+		// programs skip the overflow accounting
+		if spec.Type == ebpf.CGroupSKB && !loader.skbCgroupID &&
+			ins.OpCode == asm.OpCode(asm.JumpClass).SetJumpOp(asm.Call) &&
+			ins.Src == asm.R0 && ins.Constant == int64(asm.FnSkbCgroupId) {
+			symbol := ins.Symbol
+			*ins = asm.Mov.Imm(asm.R0, 0)
+			ins.Symbol = symbol
+			continue
+		}
+		m, ok := loader.maps[ins.Reference]
+		if ins.Reference == "" || !ok {
+			continue
+		}
+		if err := ins.RewriteMapPtr(m.FD()); err != nil {
+			return nil, loader.fail(StageLoadProgram, spec.Name, err)
+		}
+	}
+	prog, err := ebpf.NewProgram(spec)
+	if err != nil {
+		return nil, loader.fail(StageLoadProgram, spec.Name, err)
+	}
+	return prog, nil
+}
+
+func findProgramSpec(spec *ebpf.CollectionSpec, cgProg cgroupProgram) *ebpf.ProgramSpec {
+	for _, progSpec := range spec.Programs {
+		if progSpec.Type == cgProg.Type && progSpec.AttachType == cgProg.AttachType {
+			return progSpec
+		}
+	}
+	return nil
+}
+
+// replacePinnedProgram detaches and unpins the program left behind by a
+// previous run of the agent before prog takes its place.
+func (loader *BpfLoader) replacePinnedProgram(cgProg cgroupProgram, prog *ebpf.Program) error {
+	path := filepath.Join(loader.config.EbpfProgDir, cgProg.PinName)
+	if _, err := os.Stat(path); err == nil {
+		old, err := ebpf.LoadPinnedProgram(path)
+		if err != nil {
+			loader.warn(StageDetach, cgProg.PinName, err)
+		} else {
+			err = old.Detach(int(loader.cgroup.Fd()), cgProg.AttachType, bpfFAllowMulti)
+			if err != nil {
+				loader.warn(StageDetach, cgProg.PinName, err)
+			}
+			old.Close()
+		}
+		if err = os.Remove(path); err != nil {
+			return loader.fail(StagePinProgram, cgProg.PinName, err)
+		}
+	}
+	if err := prog.Pin(path); err != nil {
+		return loader.fail(StagePinProgram, cgProg.PinName, err)
+	}
+	return nil
+}
+
+// Load loads the bpf object and attaches its programs. The returned
+// error is a *BpfLoaderError identifying the step that failed, the
+// programs attached before it are then detached again.
+func (loader *BpfLoader) Load() error {
+	err := loader.load()
+	if err != nil {
+		loader.rollback()
+	}
+	return err
+}
+
+// rollback detaches and unpins the programs of a failed Load, so that no
+// partial set of programs stays attached. The maps stay pinned with the
+// counters they hold.
+func (loader *BpfLoader) rollback() {
+	loader.stateMutex.Lock()
+	attached := loader.status.Attached
+	loader.status.Attached = nil
+	loader.stateMutex.Unlock()
+	for _, cgProg := range cgroupPrograms {
+		prog, ok := loader.programs[cgProg.PinName]
+		if !ok {
+			continue
+		}
+		for _, name := range attached {
+			if name != cgProg.PinName {
+				continue
+			}
+			err := prog.Detach(int(loader.cgroup.Fd()), cgProg.AttachType, bpfFAllowMulti)
+			if err != nil {
+				loader.warn(StageDetach, cgProg.PinName, err)
+			} else {
+				loader.log.Info("Detached ", cgProg.PinName, " from ", loader.config.CgroupRoot)
+			}
+		}
+		err := os.Remove(filepath.Join(loader.config.EbpfProgDir, cgProg.PinName))
+		if err != nil && !os.IsNotExist(err) {
+			loader.warn(StagePinProgram, cgProg.PinName, err)
+		}
+		prog.Close()
+		delete(loader.programs, cgProg.PinName)
+	}
+	if loader.cgroup != nil {
+		loader.cgroup.Close()
+		loader.cgroup = nil
+	}
+}
+
+func (loader *BpfLoader) load() error {
+	loader.log.Info("Loading bpf object ", loader.config.BpfObject)
+	spec, err := ebpf.LoadCollectionSpec(loader.config.BpfObject)
+	if err != nil {
+		return loader.fail(StageLoadSpec, loader.config.BpfObject, err)
+	}
+	if err = os.MkdirAll(loader.config.EbpfMapDir, 0700); err != nil {
+		return loader.fail(StagePinMap, loader.config.EbpfMapDir, err)
+	}
+	if err = os.MkdirAll(loader.config.EbpfProgDir, 0700); err != nil {
+		return loader.fail(StagePinProgram, loader.config.EbpfProgDir, err)
+	}
+	for name, mapSpec := range spec.Maps {
+		m, err := loader.loadMap(name, loader.flowMapSpec(name, mapSpec))
+		if err != nil {
+			return err
+		}
+		loader.maps[name] = m
+		loader.stateMutex.Lock()
+		loader.status.Maps = append(loader.status.Maps, name)
+		loader.stateMutex.Unlock()
+	}
+	loader.cgroup, err = os.Open(loader.config.CgroupRoot)
+	if err != nil {
+		return loader.fail(StageOpenCgroup, loader.config.CgroupRoot, err)
+	}
+	loader.skbCgroupID = probeSkbCgroupID()
+	if !loader.skbCgroupID {
+		loader.warn(StageLoadProgram, "bpf_skb_cgroup_id",
+			errors.New("helper not supported, overflowing flows are not accounted to pods"))
+	}
+	for _, cgProg := range cgroupPrograms {
+		// Services are resolved from conntrack where socket hooks
+		// cannot be added
+		if cgProg.Type == ebpf.CGroupSockAddr &&
+			loader.config.ServiceResolution == ServiceResolutionConntrack {
+			continue
+		}
+		err = loader.attachProgram(spec, cgProg)
+		if err == nil {
+			continue
+		}
+		if !cgProg.Optional {
+			return err
+		}
+		loader.demote()
+		loader.dropProgram(cgProg)
+		if cgProg.Type == ebpf.CGroupSockAddr {
+			loader.fallBackToConntrack(cgProg)
+		}
+	}
+	return nil
+}
+
+// fallBackToConntrack resolves services from conntrack once a socket
+// address program failed, on kernels without these hooks. The programs
+// already attached are detached, a socket hook of one family or call
+// alone would only tag some of the flows.
+func (loader *BpfLoader) fallBackToConntrack(failed cgroupProgram) {
+	for _, cgProg := range cgroupPrograms {
+		if cgProg.Type == ebpf.CGroupSockAddr {
+			loader.detachProgram(cgProg)
+		}
+	}
+	loader.config.ServiceResolution = ServiceResolutionConntrack
+	loader.warn(StageAttach, failed.PinName, errors.New("resolving services from conntrack instead"))
+}
+
+// detachProgram detaches an attached program and drops it
+func (loader *BpfLoader) detachProgram(cgProg cgroupProgram) {
+	prog, ok := loader.programs[cgProg.PinName]
+	if !ok {
+		return
+	}
+	loader.stateMutex.Lock()
+	var attached []string
+	for _, name := range loader.status.Attached {
+		if name != cgProg.PinName {
+			attached = append(attached, name)
+		}
+	}
+	wasAttached := len(attached) != len(loader.status.Attached)
+	loader.status.Attached = attached
+	loader.stateMutex.Unlock()
+	if wasAttached {
+		err := prog.Detach(int(loader.cgroup.Fd()), cgProg.AttachType, bpfFAllowMulti)
+		if err != nil {
+			loader.warn(StageDetach, cgProg.PinName, err)
+		} else {
+			loader.log.Info("Detached ", cgProg.PinName, " from ", loader.config.CgroupRoot)
+		}
+	}
+	loader.dropProgram(cgProg)
+}
+
+// attachProgram loads, pins and attaches a program of the bpf object
+func (loader *BpfLoader) attachProgram(spec *ebpf.CollectionSpec, cgProg cgroupProgram) error {
+	progSpec := findProgramSpec(spec, cgProg)
+	if progSpec == nil {
+		return loader.fail(StageLoadProgram, cgProg.PinName,
+			fmt.Errorf("no program in %s", loader.config.BpfObject))
+	}
+	prog, err := loader.loadProgram(progSpec)
+	if err != nil {
+		return err
+	}
+	loader.programs[cgProg.PinName] = prog
+	if err = loader.replacePinnedProgram(cgProg, prog); err != nil {
+		return err
+	}
+	err = prog.Attach(int(loader.cgroup.Fd()), cgProg.AttachType, bpfFAllowMulti)
+	if err != nil {
+		return loader.fail(StageAttach, cgProg.PinName, err)
+	}
+	loader.log.Info("Attached ", cgProg.PinName, " to ", loader.config.CgroupRoot)
+	loader.stateMutex.Lock()
+	loader.status.Attached = append(loader.status.Attached, cgProg.PinName)
+	loader.stateMutex.Unlock()
+	return nil
+}
+
+// dropProgram unpins and closes an optional program that failed to
+// attach
+func (loader *BpfLoader) dropProgram(cgProg cgroupProgram) {
+	prog, ok := loader.programs[cgProg.PinName]
+	if !ok {
+		return
+	}
+	err := os.Remove(filepath.Join(loader.config.EbpfProgDir, cgProg.PinName))
+	if err != nil && !os.IsNotExist(err) {
+		loader.warn(StagePinProgram, cgProg.PinName, err)
+	}
+	prog.Close()
+	delete(loader.programs, cgProg.PinName)
+}
+
+// Cleanup modes applied when the agent shuts down
+const (
+	// Leave the programs attached and the maps pinned
+	CleanupNone = "none"
+	// Detach and unpin the programs, keep the pinned maps
+	CleanupDetach = "detach"
+	// Detach and unpin the programs and remove the pinned maps
+	CleanupRemove = "remove"
+)
+
+// Cleanup detaches the programs and removes pinned objects as selected by
+// mode, and releases the handles held by the loader.
+func (loader *BpfLoader) Cleanup(mode string) error {
+	var firstErr error
+	record := func(stage string, object string, err error) {
+		loaderErr := &BpfLoaderError{Stage: stage, Object: object, Err: err}
+		loader.log.Error(loaderErr.Error())
+		if firstErr == nil {
+			firstErr = loaderErr
+		}
+	}
+	if mode == CleanupDetach || mode == CleanupRemove {
+		for _, cgProg := range cgroupPrograms {
+			prog, ok := loader.programs[cgProg.PinName]
+			if !ok {
+				continue
+			}
+			err := prog.Detach(int(loader.cgroup.Fd()), cgProg.AttachType, bpfFAllowMulti)
+			if err != nil {
+				record(StageDetach, cgProg.PinName, err)
+			} else {
+				loader.log.Info("Detached ", cgProg.PinName, " from ", loader.config.CgroupRoot)
+			}
+			err = os.Remove(filepath.Join(loader.config.EbpfProgDir, cgProg.PinName))
+			if err != nil && !os.IsNotExist(err) {
+				record(StagePinProgram, cgProg.PinName, err)
+			}
+		}
+	}
+	if mode == CleanupRemove {
+		for name := range loader.maps {
+			err := os.Remove(filepath.Join(loader.config.EbpfMapDir, name))
+			if err == nil {
+				loader.log.Info("Removed pinned map ", name)
+			} else if !os.IsNotExist(err) {
+				record(StagePinMap, name, err)
+			}
+		}
+	}
+	for _, prog := range loader.programs {
+		prog.Close()
+	}
+	for _, m := range loader.maps {
+		m.Close()
+	}
+	if loader.cgroup != nil {
+		loader.cgroup.Close()
+	}
+	return firstErr
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"github.com/cilium/ebpf"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFlowMapSpec(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mapName  string
+		mapType  string
+		perCPU   bool
+		v4Size   int
+		v6Size   int
+		wantType ebpf.MapType
+		wantSize uint32
+	}{
+		{"object defaults", "v4_flow_map", FlowMapTypeHash, false, 0, 0, ebpf.Hash, 65535},
+		{"per-CPU", "v4_flow_map_1", FlowMapTypeHash, true, 0, 0, ebpf.PerCPUHash, 65535},
+		{"lru", "v6_flow_map", FlowMapTypeLRU, false, 0, 0, ebpf.LRUHash, 65535},
+		{"per-CPU lru", "v6_flow_map_1", FlowMapTypeLRU, true, 0, 0, ebpf.LRUCPUHash, 65535},
+		{"v4 size", "v4_flow_map", FlowMapTypeHash, false, 1024, 2048, ebpf.Hash, 1024},
+		{"v6 size", "v6_flow_map_1", FlowMapTypeHash, false, 1024, 2048, ebpf.Hash, 2048},
+		// Other maps keep the type and size of the object
+		{"other map", "flow_map_sel", FlowMapTypeLRU, true, 1024, 2048, ebpf.Hash, 65535},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			loader := NewBpfLoader(&StatsAgentConfig{
+				FlowMapType:   tc.mapType,
+				FlowMapPerCPU: tc.perCPU,
+				V4FlowMapSize: tc.v4Size,
+				V6FlowMapSize: tc.v6Size,
+			}, log)
+			spec := &ebpf.MapSpec{Type: ebpf.Hash, KeySize: 16, ValueSize: 8, MaxEntries: 65535}
+			got := loader.flowMapSpec(tc.mapName, spec)
+			if got.Type != tc.wantType || got.MaxEntries != tc.wantSize {
+				t.Errorf("%s map of %d entries, want %s of %d", got.Type, got.MaxEntries, tc.wantType, tc.wantSize)
+			}
+			if spec.Type != ebpf.Hash || spec.MaxEntries != 65535 {
+				t.Error("spec of the object modified")
+			}
+		})
+	}
+}
+
+func TestFallBackToConntrack(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	loader := NewBpfLoader(&StatsAgentConfig{ServiceResolution: ServiceResolutionSocket}, log)
+	for _, cgProg := range cgroupPrograms {
+		if cgProg.Type == ebpf.CGroupSockAddr && !cgProg.Optional {
+			t.Errorf("%s is required, kernels without socket hooks cannot run the agent", cgProg.PinName)
+		}
+	}
+	loader.fallBackToConntrack(cgroupProgram{"cgroup_connect6", ebpf.CGroupSockAddr, ebpf.AttachCGroupInet6Connect, true})
+	if loader.config.ServiceResolution != ServiceResolutionConntrack {
+		t.Errorf("resolving services by %s", loader.config.ServiceResolution)
+	}
+	status := loader.GetStatus()
+	if len(status.Warnings) != 1 || status.Warnings[0].Object != "cgroup_connect6" {
+		t.Errorf("warnings %+v, want one for cgroup_connect6", status.Warnings)
+	}
+}
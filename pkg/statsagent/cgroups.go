@@ -0,0 +1,75 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Minimum time between two walks of the cgroup hierarchy
+const cgroupRewalkInterval = 10 * time.Second
+
+// Pod cgroups are named pod<uid> by the cgroupfs driver and
+// kubepods-<qos>-pod<uid with underscores>.slice by the systemd driver
+var podCgroupRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// walkCgroups maps the id of every cgroup below the cgroup root, which is
+// the inode of its directory, to the uid of the pod it belongs to
+func (agent *StatsAgent) walkCgroups() map[uint64]string {
+	cgroupPodUid := make(map[uint64]string)
+	err := filepath.Walk(agent.config.CgroupRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		match := podCgroupRegexp.FindStringSubmatch(path)
+		if match == nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			cgroupPodUid[stat.Ino] = strings.Replace(match[1], "_", "-", -1)
+		}
+		return nil
+	})
+	if err != nil {
+		agent.log.Error("Failed to walk cgroups: ", err)
+	}
+	return cgroupPodUid
+}
+
+// cgroupPod returns the pod owning the cgroup with id cgroupId. Unknown
+// ids trigger a new walk of the cgroup hierarchy, at most once every
+// cgroupRewalkInterval.
+func (agent *StatsAgent) cgroupPod(cgroupId uint64) (string, bool) {
+	agent.cgroupMutex.Lock()
+	podUid, ok := agent.cgroupPodUid[cgroupId]
+	if !ok && time.Since(agent.cgroupWalkTime) > cgroupRewalkInterval {
+		agent.cgroupPodUid = agent.walkCgroups()
+		agent.cgroupWalkTime = time.Now()
+		podUid, ok = agent.cgroupPodUid[cgroupId]
+	}
+	agent.cgroupMutex.Unlock()
+	if !ok {
+		return "", false
+	}
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	podName, ok := agent.podUidToName[podUid]
+	return podName, ok
+}
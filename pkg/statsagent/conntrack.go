@@ -0,0 +1,254 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// Service resolution modes
+const (
+	// The cgroup connect and sendmsg programs record the destination of
+	// each socket
+	ServiceResolutionSocket = "socket"
+	// The agent dumps the conntrack table of the node at every scan
+	ServiceResolutionConntrack = "conntrack"
+)
+
+// ctnetlink message and attribute types, from
+// linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtGet = 1
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+
+	ctaTupleIp    = 1
+	ctaTupleProto = 2
+
+	ctaIpV4Src = 1
+	ctaIpV4Dst = 2
+	ctaIpV6Src = 3
+	ctaIpV6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+
+	// struct nfgenmsg, the family, version and resource id of the message
+	sizeofNfgenmsg = 4
+)
+
+// ctTuple is a conntrack tuple, addresses and ports in network order
+type ctTuple struct {
+	SrcIp []byte
+	DstIp []byte
+	Proto uint8
+	Sport [2]byte
+	Dport [2]byte
+}
+
+// parseAttrs splits a buffer of netlink attributes by type
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofNlAttr {
+		attrLen := int(binary.LittleEndian.Uint16(b[0:2]))
+		attrType := binary.LittleEndian.Uint16(b[2:4]) & nlaTypeMask
+		if attrLen < unix.SizeofNlAttr || attrLen > len(b) {
+			break
+		}
+		attrs[attrType] = b[unix.SizeofNlAttr:attrLen]
+		aligned := (attrLen + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+func parseCtTuple(b []byte) (ctTuple, bool) {
+	var tuple ctTuple
+	attrs := parseAttrs(b)
+	ipAttrs := parseAttrs(attrs[ctaTupleIp])
+	protoAttrs := parseAttrs(attrs[ctaTupleProto])
+	if src, ok := ipAttrs[ctaIpV4Src]; ok {
+		tuple.SrcIp, tuple.DstIp = src, ipAttrs[ctaIpV4Dst]
+	} else {
+		tuple.SrcIp, tuple.DstIp = ipAttrs[ctaIpV6Src], ipAttrs[ctaIpV6Dst]
+	}
+	if proto := protoAttrs[ctaProtoNum]; len(proto) == 1 {
+		tuple.Proto = proto[0]
+	}
+	copy(tuple.Sport[:], protoAttrs[ctaProtoSrcPort])
+	copy(tuple.Dport[:], protoAttrs[ctaProtoDstPort])
+	return tuple, len(tuple.SrcIp) != 0 && len(tuple.SrcIp) == len(tuple.DstIp)
+}
+
+// dumpConntrack calls fn with the original and reply tuples of every
+// conntrack entry of the family
+func dumpConntrack(family uint8, fn func(orig, reply *ctTuple)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	req := make([]byte, unix.SizeofNlMsghdr+sizeofNfgenmsg)
+	binary.LittleEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.LittleEndian.PutUint16(req[4:6], unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtGet)
+	binary.LittleEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	binary.LittleEndian.PutUint32(req[8:12], 1)
+	req[unix.SizeofNlMsghdr] = family
+	req[unix.SizeofNlMsghdr+1] = unix.NFNETLINK_V0
+	if err = unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return fmt.Errorf("truncated netlink error")
+				}
+				if errno := int32(binary.LittleEndian.Uint32(msg.Data[0:4])); errno != 0 {
+					return unix.Errno(-errno)
+				}
+				return nil
+			}
+			if len(msg.Data) < sizeofNfgenmsg {
+				continue
+			}
+			attrs := parseAttrs(msg.Data[sizeofNfgenmsg:])
+			orig, ook := parseCtTuple(attrs[ctaTupleOrig])
+			reply, rok := parseCtTuple(attrs[ctaTupleReply])
+			if ook && rok {
+				fn(&orig, &reply)
+			}
+		}
+	}
+}
+
+// ipWords converts an address in network order to the words of a flow key
+func ipWords(ip []byte) [4]uint32 {
+	var words [4]uint32
+	for i := 0; i+4 <= len(ip) && i < 16; i += 4 {
+		words[i/4] = binary.LittleEndian.Uint32(ip[i : i+4])
+	}
+	return words
+}
+
+// conntrackFlowKey returns the flow map key of a flow from src to the
+// local pod dst
+func (metric *FlowMetricsEntry) conntrackFlowKey(proto uint8, src, dst []byte, sport, dport [2]byte) interface{} {
+	l4 := proto_port{
+		Ip_proto: proto,
+		Sport:    binary.LittleEndian.Uint16(sport[:]),
+		Dport:    binary.LittleEndian.Uint16(dport[:]),
+	}
+	srcWords, dstWords := ipWords(src), ipWords(dst)
+	if metric.selIndex == flowMapSelV4 {
+		return inet_v4_flow{Src_ip: srcWords[0], Dst_ip: dstWords[0], L4: l4}
+	}
+	return inet_v6_flow{Src_ip: srcWords, Dst_ip: dstWords, L4: l4}
+}
+
+// localPodIps returns the addresses of the local pods in network order,
+// as conntrack tuples carry them
+func (metric *FlowMetricsEntry) localPodIps() map[string]bool {
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	localIps := make(map[string]bool, len(metric.agent.podIpToName))
+	for podIp := range metric.agent.podIpToName {
+		ip := net.ParseIP(podIp)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		localIps[string(ip)] = true
+	}
+	return localIps
+}
+
+// addConntrackSvcDst records the original destination of a translated
+// conntrack entry of a local pod. ICMP entries are keyed by id instead of
+// ports, services only translate TCP, UDP and SCTP.
+func (metric *FlowMetricsEntry) addConntrackSvcDst(svcDsts map[interface{}]svcDst, localIps map[string]bool,
+	orig, reply *ctTuple) {
+	switch orig.Proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+	default:
+		return
+	}
+	if string(orig.DstIp) == string(reply.SrcIp) {
+		return
+	}
+	if !localIps[string(reply.SrcIp)] && !localIps[string(reply.DstIp)] {
+		return
+	}
+	sd := svcDst{
+		Svc_ip:     ipWords(orig.DstIp),
+		Backend_ip: ipWords(reply.SrcIp),
+		Svc_port:   binary.LittleEndian.Uint16(orig.Dport[:]),
+	}
+	svcDsts[metric.conntrackFlowKey(reply.Proto, reply.SrcIp, reply.DstIp, reply.Sport, reply.Dport)] = sd
+	svcDsts[metric.conntrackFlowKey(reply.Proto, reply.DstIp, reply.SrcIp, reply.Dport, reply.Sport)] = sd
+}
+
+// readConntrackSvcDsts recovers the original destination of the flows of
+// local pods from the conntrack entries kube-proxy translated. A flow from
+// the backend to the client pod is keyed with the reply tuple, a flow from
+// the client to the backend pod with the reversed reply tuple, as kube-proxy
+// may have translated the client address too. The original destination is
+// the service address and port, and the backend the source of the reply.
+// The kernel dumps the whole table of the family on every scan, whose cost
+// grows with the connections of the node rather than those of its pods.
+// Only the entries of local pods are kept.
+func (metric *FlowMetricsEntry) readConntrackSvcDsts() map[interface{}]svcDst {
+	svcDsts := make(map[interface{}]svcDst)
+	family := uint8(unix.AF_INET)
+	if metric.selIndex != flowMapSelV4 {
+		family = unix.AF_INET6
+	}
+	localIps := metric.localPodIps()
+	err := dumpConntrack(family, func(orig, reply *ctTuple) {
+		metric.addConntrackSvcDst(svcDsts, localIps, orig, reply)
+	})
+	warning := ""
+	if err != nil {
+		warning = fmt.Sprintf("Failed to dump conntrack: %v", err)
+		metric.agent.log.Error("Failed to dump conntrack for ", metric.mapName, ": ", err)
+	}
+	metric.agent.setWarning("conntrack_"+metric.ipFamily, warning)
+	return svcDsts
+}
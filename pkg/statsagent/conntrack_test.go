@@ -0,0 +1,187 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+)
+
+// testNlAttr encodes a netlink attribute, padded to NLA_ALIGNTO
+func testNlAttr(attrType uint16, payload []byte) []byte {
+	b := make([]byte, unix.SizeofNlAttr+len(payload))
+	binary.LittleEndian.PutUint16(b[0:2], uint16(len(b)))
+	binary.LittleEndian.PutUint16(b[2:4], attrType)
+	copy(b[unix.SizeofNlAttr:], payload)
+	for len(b)%unix.NLA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func testCtPort(port uint16) [2]byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], port)
+	return b
+}
+
+func testCtIp(ip string) []byte {
+	parsed := net.ParseIP(ip)
+	if ip4 := parsed.To4(); ip4 != nil {
+		return ip4
+	}
+	return parsed
+}
+
+// testCtTupleAttrs encodes a tuple the way ctnetlink nests it
+func testCtTupleAttrs(tuple ctTuple) []byte {
+	srcType, dstType := uint16(ctaIpV4Src), uint16(ctaIpV4Dst)
+	if len(tuple.SrcIp) == net.IPv6len {
+		srcType, dstType = ctaIpV6Src, ctaIpV6Dst
+	}
+	ipAttrs := append(testNlAttr(srcType, tuple.SrcIp), testNlAttr(dstType, tuple.DstIp)...)
+	protoAttrs := append(testNlAttr(ctaProtoNum, []byte{tuple.Proto}), testNlAttr(ctaProtoSrcPort, tuple.Sport[:])...)
+	protoAttrs = append(protoAttrs, testNlAttr(ctaProtoDstPort, tuple.Dport[:])...)
+	return append(testNlAttr(ctaTupleIp|unix.NLA_F_NESTED, ipAttrs),
+		testNlAttr(ctaTupleProto|unix.NLA_F_NESTED, protoAttrs)...)
+}
+
+func TestParseAttrs(t *testing.T) {
+	first := testNlAttr(1, []byte{0xaa})
+	second := testNlAttr(2|unix.NLA_F_NESTED, testNlAttr(1, []byte{1, 2, 3, 4}))
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want map[uint16][]byte
+	}{
+		{"padded", append(append([]byte{}, first...), testNlAttr(3, []byte{1, 2})...),
+			map[uint16][]byte{1: {0xaa}, 3: {1, 2}}},
+		{"nested", append(append([]byte{}, first...), second...),
+			map[uint16][]byte{1: {0xaa}, 2: testNlAttr(1, []byte{1, 2, 3, 4})}},
+		{"truncated", append(append([]byte{}, first...), second[:len(second)-2]...),
+			map[uint16][]byte{1: {0xaa}}},
+		{"short header", []byte{8, 0, 1}, map[uint16][]byte{}},
+		{"length below header", []byte{2, 0, 1, 0, 0, 0, 0, 0}, map[uint16][]byte{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseAttrs(tc.b)
+			if len(got) != len(tc.want) {
+				t.Fatalf("attributes %v, want %v", got, tc.want)
+			}
+			for attrType, payload := range tc.want {
+				if !bytes.Equal(got[attrType], payload) {
+					t.Errorf("attribute %d is %v, want %v", attrType, got[attrType], payload)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCtTuple(t *testing.T) {
+	v4 := ctTuple{
+		SrcIp: testCtIp(testClientIp), DstIp: testCtIp(testSvcIp),
+		Proto: unix.IPPROTO_TCP, Sport: testCtPort(40000), Dport: testCtPort(80),
+	}
+	v6 := ctTuple{
+		SrcIp: testCtIp("fd00::1"), DstIp: testCtIp("fd00:96::10"),
+		Proto: unix.IPPROTO_UDP, Sport: testCtPort(40000), Dport: testCtPort(53),
+	}
+	v4Attrs := testCtTupleAttrs(v4)
+	noDst := append(testNlAttr(ctaTupleIp|unix.NLA_F_NESTED, testNlAttr(ctaIpV4Src, v4.SrcIp)),
+		testNlAttr(ctaTupleProto|unix.NLA_F_NESTED, testNlAttr(ctaProtoNum, []byte{v4.Proto}))...)
+	for _, tc := range []struct {
+		name   string
+		b      []byte
+		want   ctTuple
+		wantOk bool
+	}{
+		{"ipv4", v4Attrs, v4, true},
+		{"ipv6", testCtTupleAttrs(v6), v6, true},
+		// The addresses are read, the ports of the cut protocol
+		// attributes are not
+		{"truncated ports", v4Attrs[:len(v4Attrs)-4],
+			ctTuple{SrcIp: v4.SrcIp, DstIp: v4.DstIp}, true},
+		{"truncated addresses", v4Attrs[:12], ctTuple{}, false},
+		{"no destination", noDst, ctTuple{SrcIp: v4.SrcIp, Proto: v4.Proto}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseCtTuple(tc.b)
+			if ok != tc.wantOk {
+				t.Fatalf("parsed %v, want %v", ok, tc.wantOk)
+			}
+			if !bytes.Equal(got.SrcIp, tc.want.SrcIp) || !bytes.Equal(got.DstIp, tc.want.DstIp) ||
+				got.Proto != tc.want.Proto || got.Sport != tc.want.Sport || got.Dport != tc.want.Dport {
+				t.Errorf("tuple %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddConntrackSvcDst(t *testing.T) {
+	const backendPort = 8080
+	clientToSvc := ctTuple{
+		SrcIp: testCtIp(testClientIp), DstIp: testCtIp(testSvcIp),
+		Proto: unix.IPPROTO_TCP, Sport: testCtPort(40000), Dport: testCtPort(80),
+	}
+	backendToClient := ctTuple{
+		SrcIp: testCtIp(testServerIp), DstIp: testCtIp(testClientIp),
+		Proto: unix.IPPROTO_TCP, Sport: testCtPort(backendPort), Dport: testCtPort(40000),
+	}
+	icmp := func(tuple ctTuple) ctTuple {
+		tuple.Proto = unix.IPPROTO_ICMP
+		return tuple
+	}
+	remote := func(tuple ctTuple) ctTuple {
+		tuple.SrcIp = testCtIp("192.168.1.20")
+		tuple.DstIp = testCtIp("192.168.1.21")
+		return tuple
+	}
+	toBackend := testV4Flow(testClientIp, 40000, testServerIp, backendPort)
+	toClient := testV4Flow(testServerIp, backendPort, testClientIp, 40000)
+	for _, tc := range []struct {
+		name  string
+		orig  ctTuple
+		reply ctTuple
+		want  []inet_v4_flow
+	}{
+		{"translated", clientToSvc, backendToClient, []inet_v4_flow{toBackend, toClient}},
+		{"icmp", icmp(clientToSvc), icmp(backendToClient), nil},
+		{"not translated", backendToClient, clientToSvc, nil},
+		{"not local", remote(clientToSvc), remote(backendToClient), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, _ := newTestAgent()
+			metric := NewInetV4FlowMetricsEntry(agent)
+			svcDsts := make(map[interface{}]svcDst)
+			metric.addConntrackSvcDst(svcDsts, metric.localPodIps(), &tc.orig, &tc.reply)
+			if len(svcDsts) != len(tc.want) {
+				t.Fatalf("destinations %v, want %d", svcDsts, len(tc.want))
+			}
+			for _, key := range tc.want {
+				sd, ok := svcDsts[key]
+				if !ok {
+					t.Fatalf("no destination for %+v", key)
+				}
+				if ipString(sd.Svc_ip, true) != testSvcIp || ipString(sd.Backend_ip, true) != testServerIp ||
+					portValue(sd.Svc_port) != 80 {
+					t.Errorf("destination %+v", sd)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EndpointSliceInfo is the service of an EndpointSlice and the backend
+// keys it added to backendToSvc, which maps the ports of the backend pods
+// of all slices to their service
+type EndpointSliceInfo struct {
+	Svc      string
+	Backends []string
+}
+
+// backendKey identifies a port of a backend pod, proto being a protocol
+// name of the protocol label
+func backendKey(proto string, ip string, port string) string {
+	return proto + "/" + net.JoinHostPort(ip, port)
+}
+
+func (agent *StatsAgent) initEndpointSliceInformerFromClient(
+	kubeClient *kubernetes.Clientset) {
+	agent.initEndpointSliceInformerBase(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return kubeClient.DiscoveryV1beta1().EndpointSlices(metav1.NamespaceAll).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return kubeClient.DiscoveryV1beta1().EndpointSlices(metav1.NamespaceAll).Watch(context.TODO(), options)
+			},
+		})
+}
+
+func (agent *StatsAgent) initEndpointSliceInformerBase(listWatch *cache.ListWatch) {
+	agent.sliceInformer = cache.NewSharedIndexInformer(
+		listWatch,
+		&discovery.EndpointSlice{},
+		noResyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	agent.sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			agent.endpointSliceUpdated(obj)
+		},
+		UpdateFunc: func(_ interface{}, obj interface{}) {
+			agent.endpointSliceUpdated(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			agent.endpointSliceDeleted(obj)
+		},
+	})
+}
+
+// endpointSliceUpdated indexes every address and port of the slice,
+// whether ready or not, as terminating backends still serve the service
+func (agent *StatsAgent) endpointSliceUpdated(obj interface{}) {
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(slice)
+	if err != nil {
+		agent.log.Error("Could not create key for EndpointSlice: " + err.Error())
+		return
+	}
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	agent.removeSliceBackends(key)
+	svcName, ok := slice.ObjectMeta.Labels[discovery.LabelServiceName]
+	if !ok {
+		return
+	}
+	sliceInfo := EndpointSliceInfo{Svc: slice.ObjectMeta.Namespace + "/" + svcName}
+	for _, ep := range slice.Endpoints {
+		for _, addr := range ep.Addresses {
+			for _, port := range slice.Ports {
+				if port.Port == nil {
+					continue
+				}
+				proto := v1.ProtocolTCP
+				if port.Protocol != nil {
+					proto = *port.Protocol
+				}
+				bk := backendKey(strings.ToLower(string(proto)), addr, strconv.Itoa(int(*port.Port)))
+				agent.backendToSvc[bk] = sliceInfo.Svc
+				sliceInfo.Backends = append(sliceInfo.Backends, bk)
+			}
+		}
+	}
+	agent.log.Debug("Added EndpointSlice ", key, " of svc ", sliceInfo.Svc)
+	agent.sliceInfo[key] = sliceInfo
+}
+
+func (agent *StatsAgent) endpointSliceDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(slice)
+	if err != nil {
+		agent.log.Error("Could not create key for EndpointSlice: " + err.Error())
+		return
+	}
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	agent.log.Debug("Deleting EndpointSlice ", key)
+	agent.removeSliceBackends(key)
+}
+
+// removeSliceBackends removes the backends of a slice, unless another
+// slice indexes them, as an endpoint moving between slices is briefly
+// listed by both. Called with stateMutex held.
+func (agent *StatsAgent) removeSliceBackends(key string) {
+	sliceInfo, ok := agent.sliceInfo[key]
+	if !ok {
+		return
+	}
+	delete(agent.sliceInfo, key)
+	removed := make(map[string]bool)
+	for _, bk := range sliceInfo.Backends {
+		if agent.backendToSvc[bk] == sliceInfo.Svc {
+			delete(agent.backendToSvc, bk)
+			removed[bk] = true
+		}
+	}
+	for _, other := range agent.sliceInfo {
+		if len(removed) == 0 {
+			return
+		}
+		for _, bk := range other.Backends {
+			if removed[bk] {
+				agent.backendToSvc[bk] = other.Svc
+				delete(removed, bk)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+// testEndpointSlice returns a slice of the web service listing addresses
+// on a port, of TCP when proto is nil
+func testEndpointSlice(name string, addrs []string, port int32, proto *v1.Protocol) *discovery.EndpointSlice {
+	slice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{discovery.LabelServiceName: "web"},
+		},
+		Ports: []discovery.EndpointPort{{Port: &port, Protocol: proto}},
+	}
+	for _, addr := range addrs {
+		slice.Endpoints = append(slice.Endpoints, discovery.Endpoint{Addresses: []string{addr}})
+	}
+	return slice
+}
+
+func TestEndpointSliceUpdated(t *testing.T) {
+	udp := v1.ProtocolUDP
+	unlabelled := testEndpointSlice("web-abc", []string{testServerIp}, 80, nil)
+	unlabelled.ObjectMeta.Labels = nil
+	for _, tc := range []struct {
+		name  string
+		slice *discovery.EndpointSlice
+		want  []string
+	}{
+		{"every address", testEndpointSlice("web-abc", []string{testClientIp, testServerIp}, 80, nil),
+			[]string{backendKey(protoTcp, testClientIp, "80"), backendKey(protoTcp, testServerIp, "80")}},
+		{"protocol", testEndpointSlice("web-abc", []string{testServerIp}, 53, &udp),
+			[]string{backendKey("udp", testServerIp, "53")}},
+		{"no service", unlabelled, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, _ := newTestAgent()
+			agent.endpointSliceUpdated(tc.slice)
+			if len(agent.backendToSvc) != len(tc.want) {
+				t.Fatalf("backends %v, want %v", agent.backendToSvc, tc.want)
+			}
+			for _, bk := range tc.want {
+				if agent.backendToSvc[bk] != "default/web" {
+					t.Errorf("backend %s of %q, want default/web", bk, agent.backendToSvc[bk])
+				}
+			}
+		})
+	}
+}
+
+func TestEndpointSliceUnindexed(t *testing.T) {
+	clientKey := backendKey(protoTcp, testClientIp, "80")
+	serverKey := backendKey(protoTcp, testServerIp, "80")
+	both := testEndpointSlice("web-abc", []string{testClientIp, testServerIp}, 80, nil)
+	for _, tc := range []struct {
+		name   string
+		change func(agent *StatsAgent)
+		want   []string
+	}{
+		{"address removed", func(agent *StatsAgent) {
+			agent.endpointSliceUpdated(testEndpointSlice("web-abc", []string{testServerIp}, 80, nil))
+		}, []string{serverKey}},
+		{"deleted", func(agent *StatsAgent) {
+			agent.endpointSliceDeleted(both)
+		}, nil},
+		{"deleted while not watching", func(agent *StatsAgent) {
+			agent.endpointSliceDeleted(cache.DeletedFinalStateUnknown{Key: "default/web-abc", Obj: both})
+		}, nil},
+		// An endpoint moving to another slice is listed by both
+		// until the first slice is updated
+		{"address moved", func(agent *StatsAgent) {
+			agent.endpointSliceUpdated(testEndpointSlice("web-def", []string{testServerIp}, 80, nil))
+			agent.endpointSliceUpdated(testEndpointSlice("web-abc", []string{testClientIp}, 80, nil))
+		}, []string{clientKey, serverKey}},
+		{"other slice deleted", func(agent *StatsAgent) {
+			other := testEndpointSlice("web-def", []string{testServerIp}, 80, nil)
+			agent.endpointSliceUpdated(other)
+			agent.endpointSliceDeleted(other)
+		}, []string{clientKey, serverKey}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, _ := newTestAgent()
+			agent.endpointSliceUpdated(both)
+			tc.change(agent)
+			if len(agent.backendToSvc) != len(tc.want) {
+				t.Fatalf("backends %v, want %v", agent.backendToSvc, tc.want)
+			}
+			for _, bk := range tc.want {
+				if _, ok := agent.backendToSvc[bk]; !ok {
+					t.Errorf("backend %s not indexed", bk)
+				}
+			}
+		})
+	}
+}
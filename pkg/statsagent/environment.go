@@ -15,7 +15,6 @@
 package statsagent
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -24,18 +23,23 @@ import (
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"time"
 )
 
+// The informers only react to watch events, without periodic resyncs
+const noResyncPeriod = 0 * time.Second
+
 type Environment interface {
 	Init(agent *StatsAgent) error
 	PrepareRun(stopCh <-chan struct{}) (bool, error)
+	Cleanup() error
 }
 
 type K8sEnvironment struct {
 	kubeClient *kubernetes.Clientset
 	agent      *StatsAgent
+	bpfLoader  *BpfLoader
 	//        serviceInformer     cache.SharedIndexInformer
 	//        nodeInformer        cache.SharedIndexInformer
 }
@@ -51,6 +55,33 @@ func NewK8sEnvironment(config *StatsAgentConfig, log *logrus.Logger) (*K8sEnviro
 		return nil, err
 	}
 
+	switch config.CleanupMode {
+	case CleanupNone, CleanupDetach, CleanupRemove:
+	default:
+		err := fmt.Errorf("Unknown cleanup mode %s", config.CleanupMode)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	switch config.ServiceResolution {
+	case ServiceResolutionSocket, ServiceResolutionConntrack:
+	default:
+		err := fmt.Errorf("Unknown service resolution %s", config.ServiceResolution)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	switch {
+	case config.FlowMapType != FlowMapTypeHash && config.FlowMapType != FlowMapTypeLRU:
+		err := fmt.Errorf("Unknown flow map type %s", config.FlowMapType)
+		log.Error(err.Error())
+		return nil, err
+	case config.V4FlowMapSize < 0 || config.V6FlowMapSize < 0:
+		err := errors.New("Flow map sizes cannot be negative")
+		log.Error(err.Error())
+		return nil, err
+	}
+
 	envCgroupRoot := os.Getenv("CGROUP_ROOT")
 	if envCgroupRoot != "" {
 		config.CgroupRoot = envCgroupRoot
@@ -58,19 +89,20 @@ func NewK8sEnvironment(config *StatsAgentConfig, log *logrus.Logger) (*K8sEnviro
 	mapDir, _ := filepath.Rel("/sys/fs/bpf", config.EbpfMapDir)
 	mapDir = "/ebpf/" + mapDir
 	config.EbpfMapDir = mapDir
+	progDir, _ := filepath.Rel("/sys/fs/bpf", config.EbpfProgDir)
+	progDir = "/ebpf/" + progDir
+	config.EbpfProgDir = progDir
 	cgroupRoot, _ := filepath.Rel("/sys/fs/cgroup", config.CgroupRoot)
 	cgroupRoot = "/cgroup/" + cgroupRoot
-	log.Debug("Using cgroup ", cgroupRoot, " map directory ", mapDir)
-	mapStr := fmt.Sprintf("EBPF_MAP_DIR=%s", mapDir)
-	cgroupStr := fmt.Sprintf("CGROUP_MOUNT=%s", cgroupRoot)
-	cmd := exec.Command("/bin/load_attach_bpf_cgroup.sh")
-	cmd.Env = append(os.Environ(), mapStr, cgroupStr)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
-	log.Debug(out.String())
+	config.CgroupRoot = cgroupRoot
+	log.Debug("Using cgroup ", cgroupRoot, " map directory ", mapDir, " program directory ", progDir)
+	bpfLoader := NewBpfLoader(config, log)
+	err := bpfLoader.Load()
 	if err != nil {
+		// The environment only holds the loader, whose status tells why
+		// the agent refuses to start, see InitStatus
 		log.Error(err.Error())
+		return &K8sEnvironment{bpfLoader: bpfLoader}, err
 	}
 
 	log.WithFields(logrus.Fields{
@@ -92,7 +124,7 @@ func NewK8sEnvironment(config *StatsAgentConfig, log *logrus.Logger) (*K8sEnviro
 		return nil, err
 	}
 
-	return &K8sEnvironment{kubeClient: kubeClient}, nil
+	return &K8sEnvironment{kubeClient: kubeClient, bpfLoader: bpfLoader}, nil
 }
 
 func (env *K8sEnvironment) PrepareRun(stopCh <-chan struct{}) (bool, error) {
@@ -106,7 +138,12 @@ func (env *K8sEnvironment) PrepareRun(stopCh <-chan struct{}) (bool, error) {
 	//env.agent.log.Debug("Exporting node info: ", env.agent.config.NodeName)
 	go env.agent.podInformer.Run(stopCh)
 	go env.agent.svcInformer.Run(stopCh)
-	cache.WaitForCacheSync(stopCh, env.agent.podInformer.HasSynced)
+	go env.agent.sliceInformer.Run(stopCh)
+	go env.agent.nodeInformer.Run(stopCh)
+	// Flows of backend pods are only attributed to their services once
+	// the services and their EndpointSlices are known
+	cache.WaitForCacheSync(stopCh, env.agent.podInformer.HasSynced,
+		env.agent.svcInformer.HasSynced, env.agent.sliceInformer.HasSynced)
 	//go env.agent.controllerInformer.Run(stopCh)
 	//env.agent.serviceEndPoints.Run(stopCh)
 	//go env.agent.serviceInformer.Run(stopCh)
@@ -119,15 +156,32 @@ func (env *K8sEnvironment) PrepareRun(stopCh <-chan struct{}) (bool, error) {
 
 func (env *K8sEnvironment) Init(agent *StatsAgent) error {
 	env.agent = agent
+	env.agent.bpfLoader = env.bpfLoader
 
 	env.agent.log.Debug("Initializing informers")
-	//env.agent.initNodeInformerFromClient(env.kubeClient)
+	env.agent.initNodeInformerFromClient(env.kubeClient)
 	env.agent.initPodInformerFromClient(env.kubeClient)
 	env.agent.initServiceInformerFromClient(env.kubeClient)
+	env.agent.initEndpointSliceInformerFromClient(env.kubeClient)
 	//env.agent.serviceEndPoints.InitClientInformer(env.kubeClient)
 	//env.agent.initNamespaceInformerFromClient(env.kubeClient)
 	env.agent.log.Debug("Registering Metrics")
 	env.agent.registerMetrics()
 	env.agent.registerPrometheusMetrics()
+	for name, abi := range env.bpfLoader.FlowMapABIs() {
+		env.agent.SetFlowMapInfo(name, abi.Type.String(), abi.MaxEntries)
+	}
 	return nil
 }
+
+// InitStatus ties the agent to the loader of an environment that failed to
+// load the bpf object, so that /status reports the failure
+func (env *K8sEnvironment) InitStatus(agent *StatsAgent) {
+	env.agent = agent
+	env.agent.bpfLoader = env.bpfLoader
+}
+
+func (env *K8sEnvironment) Cleanup() error {
+	env.agent.log.Info("Cleaning up with mode ", env.agent.config.CleanupMode)
+	return env.bpfLoader.Cleanup(env.agent.config.CleanupMode)
+}
@@ -0,0 +1,338 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cilium/ebpf/perf"
+	"os"
+	"time"
+)
+
+// The kernel sends a flowEvent over flowEventsName for every new connection
+// it inserts in a flow map when flowConfigNewEvents is set in
+// flowConfigName, and once a buffer holds as many flows as the threshold
+// of its family in flowConfigName. flowCountsName holds the flows inserted
+// in each buffer, at family * 2 + buffer.
+const (
+	flowEventsName      = "flow_events"
+	flowCountsName      = "flow_counts"
+	flowConfigName      = "flow_config"
+	flowConfigNewEvents = 2
+)
+
+// Types of flowEvent
+const (
+	flowEventNew   uint32 = 1
+	flowEventFill  uint32 = 2
+	flowEventClose uint32 = 3
+)
+
+// TCP flags of flowEvent and FlowStats
+const (
+	tcpFlagFin uint32 = 0x01
+	tcpFlagSyn uint32 = 0x02
+	tcpFlagRst uint32 = 0x04
+	tcpFlagAck uint32 = 0x10
+)
+
+const ipProtoTcp = 6
+
+// Size in pages of the per-CPU flow event buffers
+const flowEventPages = 8
+
+// Buffer is the flow map buffer holding the flow, and Tcp_flags the flags
+// of the packet that caused the event
+type flowEvent struct {
+	Type      uint32
+	Family    uint32
+	Src_ip    [4]uint32
+	Dst_ip    [4]uint32
+	L4        proto_port
+	Buffer    uint32
+	Tcp_flags uint32
+}
+
+// flowKey returns the flow map key of the flow the event is about
+func (event *flowEvent) flowKey() FlowKey {
+	if event.Family == flowMapSelV4 {
+		return &inet_v4_flow{Src_ip: event.Src_ip[0], Dst_ip: event.Dst_ip[0], L4: event.L4}
+	}
+	return &inet_v6_flow{Src_ip: event.Src_ip, Dst_ip: event.Dst_ip, L4: event.L4}
+}
+
+// flowEventHandler is implemented by MetricsEntries that consume flow
+// events
+type flowEventHandler interface {
+	handleFlowEvent(event *flowEvent)
+}
+
+// runFlowEvents reads the flow events of the kernel and passes them to the
+// metrics until stopCh is closed
+func (agent *StatsAgent) runFlowEvents(stopCh <-chan struct{}) {
+	if agent.bpfLoader == nil || agent.bpfLoader.Map(flowEventsName) == nil {
+		agent.log.Info("No ", flowEventsName, " map, scans are only periodic")
+		return
+	}
+	rd, err := perf.NewReader(agent.bpfLoader.Map(flowEventsName), os.Getpagesize()*flowEventPages)
+	if err != nil {
+		agent.log.Error("Failed to read ", flowEventsName, ": ", err)
+		return
+	}
+	go func() {
+		<-stopCh
+		rd.Close()
+	}()
+	go func() {
+		var lost uint64
+		for {
+			record, err := rd.Read()
+			if perf.IsClosed(err) {
+				return
+			}
+			if err != nil {
+				agent.log.Error("Failed to read ", flowEventsName, ": ", err)
+				continue
+			}
+			if record.LostSamples != 0 {
+				lost += record.LostSamples
+				agent.SetFlowEventsLostGauge(lost)
+				continue
+			}
+			var event flowEvent
+			err = binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event)
+			if err != nil {
+				agent.log.Error("Failed to decode flow event: ", err)
+				continue
+			}
+			for _, m := range agent.metrics {
+				if handler, ok := m.(flowEventHandler); ok {
+					handler.handleFlowEvent(&event)
+				}
+			}
+		}
+	}()
+}
+
+// ScanTrigger returns the channel on which the entry asks runMetric for an
+// early scan
+func (metric *FlowMetricsEntry) ScanTrigger() <-chan struct{} {
+	return metric.trigger
+}
+
+// handleFlowEvent counts the new connections, finalizes closed flows, and
+// asks for a scan when the active buffer fills up, at most once per
+// shortest scan interval. The kernel only sends new flows that are
+// connections, they are counted by destination and attributed to the pods
+// on the next scan.
+func (metric *FlowMetricsEntry) handleFlowEvent(event *flowEvent) {
+	if event.Family != metric.selIndex {
+		return
+	}
+	switch event.Type {
+	case flowEventNew:
+		// Flows are keyed with the local pod as destination
+		dstIp := event.flowKey().GetDstIp()
+		metric.eventMutex.Lock()
+		metric.newConns[dstIp]++
+		metric.eventMutex.Unlock()
+	case flowEventClose:
+		metric.finalizeFlow(event)
+	case flowEventFill:
+		minInterval, _ := metric.agent.config.statsIntervalBounds()
+		metric.eventMutex.Lock()
+		defer metric.eventMutex.Unlock()
+		if time.Since(metric.lastTrigger) < time.Duration(minInterval)*time.Second {
+			return
+		}
+		metric.lastTrigger = time.Now()
+		metric.agent.log.Debug(metric.mapName, " is filling up, scanning early")
+		select {
+		case metric.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setFillThreshold tells the kernel how many flows in a buffer should
+// trigger a scan, the count at which adaptInterval shortens the interval
+func (metric *FlowMetricsEntry) setFillThreshold() {
+	if metric.agent.bpfLoader == nil {
+		return
+	}
+	abi, ok := metric.agent.bpfLoader.FlowMapABIs()[metric.mapName]
+	if !ok {
+		return
+	}
+	config, err := metric.agent.flowMapOpener(flowConfigName)
+	if err != nil {
+		metric.agent.log.Debug("Not setting fill threshold: ", err)
+		return
+	}
+	defer config.Close()
+	threshold := uint64(float64(abi.MaxEntries) * flowMapFillHigh)
+	if err = config.Put(metric.selIndex, threshold); err != nil {
+		metric.agent.log.Error("Failed to set fill threshold of ", metric.mapName, ": ", err)
+	}
+}
+
+// setNewEvents tells the kernel whether to send an event for every new
+// connection
+func (metric *FlowMetricsEntry) setNewEvents() {
+	config, err := metric.agent.flowMapOpener(flowConfigName)
+	if err != nil {
+		metric.agent.log.Debug("Not configuring new flow events: ", err)
+		return
+	}
+	defer config.Close()
+	var enabled uint64
+	if metric.agent.config.FlowNewEvents {
+		enabled = 1
+	}
+	if err = config.Put(uint32(flowConfigNewEvents), enabled); err != nil {
+		metric.agent.log.Error("Failed to configure new flow events: ", err)
+	}
+}
+
+// resetFlowCount restarts the count of flows inserted in the drained
+// buffer
+func (metric *FlowMetricsEntry) resetFlowCount(buffer uint32) {
+	counts, err := metric.agent.flowMapOpener(flowCountsName)
+	if err != nil {
+		metric.agent.log.Debug("Not resetting flow count: ", err)
+		return
+	}
+	defer counts.Close()
+	if err = counts.Put(metric.selIndex*2+buffer, uint64(0)); err != nil {
+		metric.agent.log.Error("Failed to reset flow count of ", metric.flowMapName(buffer), ": ", err)
+	}
+}
+
+// updateConnRates exports the rate of new connections per pod since the
+// last scan, which ran until t. Connections to addresses that are not
+// local pods are not counted. Pods without new connections report 0
+// until they are deleted.
+func (metric *FlowMetricsEntry) updateConnRates(t time.Time) {
+	metric.eventMutex.Lock()
+	newConns := metric.newConns
+	metric.newConns = make(map[string]uint64)
+	metric.eventMutex.Unlock()
+	elapsed := t.Sub(metric.lastScan).Seconds()
+	metric.lastScan = t
+	if elapsed <= 0 {
+		return
+	}
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	podConns := make(map[string]uint64)
+	for dstIp, count := range newConns {
+		if podName, ok := metric.agent.podIpToName[dstIp]; ok {
+			podConns[podName] += count
+		}
+	}
+	for podName, count := range podConns {
+		metric.agent.SetPodConnGauge(podName, metric.ipFamily, float64(count)/elapsed)
+		metric.connRates[podName] = true
+	}
+	for podName := range metric.connRates {
+		if _, ok := podConns[podName]; ok {
+			continue
+		}
+		if _, ok := metric.agent.podInfo[podName]; ok {
+			metric.agent.SetPodConnGauge(podName, metric.ipFamily, 0)
+		} else {
+			metric.agent.DeletePodConnGauge(podName, metric.ipFamily)
+			delete(metric.connRates, podName)
+		}
+	}
+}
+
+// takeFlow moves the counters of a flow out of a flow map buffer into
+// baseMap
+func (metric *FlowMetricsEntry) takeFlow(keyOut FlowKey, buffer uint32, t *time.Time) error {
+	m, err := metric.agent.flowMapOpener(metric.flowMapName(buffer))
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	var valueOut FlowStats
+	if err = m.Lookup(keyOut, &valueOut); err != nil {
+		return nil
+	}
+	if err = m.Delete(keyOut); err != nil {
+		return err
+	}
+	metric.addFlow(keyOut, &valueOut, t)
+	return nil
+}
+
+// finalizeFlow moves the counters of a TCP flow that sent a FIN or a RST
+// out of both flow map buffers, so that baseMap holds the flags of the
+// flow across swaps. The event completing the close, a RST or the FIN of
+// the second direction, records the duration of the flow for its
+// endpoints instead of waiting for it to age out, moves the flow to
+// closedFlows and deletes its original destination. Later events of the
+// flow are ignored. Packets counted between a lookup and the delete are
+// lost. If a delete fails the flow is left to the next scan.
+func (metric *FlowMetricsEntry) finalizeFlow(event *flowEvent) {
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	keyOut := event.flowKey()
+	key := flowKeyValue(keyOut)
+	if _, ok := metric.closedFlows[key]; ok {
+		return
+	}
+	t := time.Now()
+	for _, buffer := range []uint32{event.Buffer, 1 - event.Buffer} {
+		if err := metric.takeFlow(keyOut, buffer, &t); err != nil {
+			metric.agent.log.Debug("Not finalizing flow: ", err)
+			return
+		}
+	}
+	base, ok := metric.baseMap[key]
+	if !ok {
+		return
+	}
+	flags := base.Stats.Tcp_flags_out | base.Stats.Tcp_flags_in
+	if flags&tcpFlagRst == 0 && base.Stats.Tcp_flags_out&base.Stats.Tcp_flags_in&tcpFlagFin == 0 {
+		return
+	}
+	metric.lookupSvcDst(keyOut)
+	podStatsKey, keyType := metric.podStatsKey(keyOut)
+	metric.observeDuration(keyType, podStatsKey, base.Stats.Duration(), metric.agent.ObserveConnDuration)
+	metric.observeDuration(keyType, podStatsKey, base.Stats.Duration(), metric.agent.ObserveFlowDuration)
+	delete(metric.baseMap, key)
+	metric.closedFlows[key] = base
+	metric.deleteSvcDsts([]interface{}{key})
+}
+
+// observeDuration records the duration of a connection or flow with
+// observe for each endpoint that is a pod or a service, like mergeStats
+// does for the counters
+func (metric *FlowMetricsEntry) observeDuration(keyType int, podStatsKey PodStatsKey, duration time.Duration,
+	observe func(*PromMetricsKey, time.Duration)) {
+	if keyType&(FROM_POD_KEY|FROM_SVC_KEY) != 0 {
+		srcStatsKey := podStatsKey
+		(&srcStatsKey).clear(1)
+		observe(srcStatsKey.toPromMetricsKey(metric.agent, metric.ipFamily), duration)
+	}
+	if keyType&(TO_POD_KEY|TO_SVC_KEY) != 0 {
+		dstStatsKey := podStatsKey
+		(&dstStatsKey).swap()
+		(&dstStatsKey).clear(1)
+		observe(dstStatsKey.toPromMetricsKey(metric.agent, metric.ipFamily), duration)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+// ICMP and ICMPv6 flows are keyed by type in Sport and code in Dport
+
+const (
+	ipProtoIcmp   = 1
+	ipProtoIcmpv6 = 58
+)
+
+// Counters of icmpCounts, in the order of PodIcmpPromMetrics
+const (
+	icmpEchoRequests = iota
+	icmpUnreachables
+	icmpFragNeeded
+	icmpTimeExceeded
+	icmpCounters
+)
+
+// icmpCounts holds the packets received and sent by a pod for each counter
+type icmpCounts [icmpCounters][2]uint64
+
+// flowL4 returns the protocol and ports of a flow key
+func flowL4(keyOut FlowKey) *proto_port {
+	switch key := keyOut.(type) {
+	case *inet_v4_flow:
+		return &key.L4
+	case *inet_v6_flow:
+		return &key.L4
+	}
+	return nil
+}
+
+// portValue converts a port of a flow key from network order
+func portValue(port uint16) uint16 {
+	return port>>8 | port<<8
+}
+
+// icmpCounter returns the counter of an ICMP or ICMPv6 type and code, or -1
+// for messages that are not counted
+func icmpCounter(proto uint8, icmpType uint8, icmpCode uint8) int {
+	switch proto {
+	case ipProtoIcmp:
+		switch icmpType {
+		case 8:
+			return icmpEchoRequests
+		case 3:
+			if icmpCode == 4 {
+				return icmpFragNeeded
+			}
+			return icmpUnreachables
+		case 11:
+			return icmpTimeExceeded
+		}
+	case ipProtoIcmpv6:
+		switch icmpType {
+		case 128:
+			return icmpEchoRequests
+		case 1:
+			return icmpUnreachables
+		case 2:
+			return icmpFragNeeded
+		case 3:
+			return icmpTimeExceeded
+		}
+	}
+	return -1
+}
+
+// countIcmp adds the packets of an ICMP flow to the counters of its local
+// pod. Flows are keyed with the pod as destination, so the out counters
+// are the packets it received.
+func (metric *FlowMetricsEntry) countIcmp(keyOut FlowKey, keyType int, podStatsKey PodStatsKey, stats *FlowStats) {
+	l4 := flowL4(keyOut)
+	if l4 == nil || keyType&TO_POD_KEY == 0 {
+		return
+	}
+	counter := icmpCounter(l4.Ip_proto, uint8(portValue(l4.Sport)), uint8(portValue(l4.Dport)))
+	if counter < 0 || stats.Out_packets+stats.In_packets == 0 {
+		return
+	}
+	podName := podStatsKey.Endpoints[1]
+	counts, ok := metric.icmpStats[podName]
+	if !ok {
+		counts = &icmpCounts{}
+		metric.icmpStats[podName] = counts
+	}
+	counts[counter][0] += stats.Out_packets
+	counts[counter][1] += stats.In_packets
+	metric.agent.SetPodIcmpGauges(podName, metric.ipFamily, counts)
+}
+
+// ageIcmpStats forgets the ICMP counters of deleted pods
+func (metric *FlowMetricsEntry) ageIcmpStats() {
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	for podName := range metric.icmpStats {
+		if _, ok := metric.agent.podInfo[podName]; !ok {
+			metric.agent.DeletePodIcmpGauges(podName, metric.ipFamily)
+			delete(metric.icmpStats, podName)
+		}
+	}
+}
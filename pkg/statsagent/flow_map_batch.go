@@ -0,0 +1,228 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// FlowMapDrainer is implemented by FlowMapSources that can read and delete
+// their entries in bulk. Drain decodes every entry it removes into keyOut
+// and valueOut, as FlowMapIterator.Next does, and calls fn for it. Entries
+// left over when Drain fails can still be read with Iterate.
+type FlowMapDrainer interface {
+	Drain(keyOut, valueOut interface{}, fn func()) error
+}
+
+// ErrBatchNotSupported is returned by Drain when the kernel lacks the
+// batch map operations
+var ErrBatchNotSupported = errors.New("batch map operations not supported")
+
+// BPF_MAP_LOOKUP_AND_DELETE_BATCH, available since linux 5.6
+const bpfMapLookupAndDeleteBatch = 25
+
+// Entries read per BPF_MAP_LOOKUP_AND_DELETE_BATCH call
+const flowMapBatchSize = 4096
+
+// ENOTSUPP, returned by kernel maps without batch support
+const errnoENOTSUPP = unix.Errno(524)
+
+// batchSupport remembers the maps whose batch operations the kernel
+// rejected, support depends on the kernel and on the map type
+type batchSupport struct {
+	mutex       sync.Mutex
+	unsupported map[string]bool
+}
+
+func newBatchSupport() *batchSupport {
+	return &batchSupport{unsupported: make(map[string]bool)}
+}
+
+// drain drains the named map with d unless batching was rejected for it
+// before, and stops batching for the map once it is rejected
+func (support *batchSupport) drain(mapName string, d *batchDrainer, keyOut, valueOut interface{}, fn func()) error {
+	support.mutex.Lock()
+	unsupported := support.unsupported[mapName]
+	support.mutex.Unlock()
+	if unsupported {
+		return ErrBatchNotSupported
+	}
+	err := d.drain(keyOut, valueOut, fn)
+	if err == ErrBatchNotSupported {
+		support.mutex.Lock()
+		support.unsupported[mapName] = true
+		support.mutex.Unlock()
+	}
+	return err
+}
+
+// bpfBatchAttr is the batch member of union bpf_attr
+type bpfBatchAttr struct {
+	InBatch   uint64
+	OutBatch  uint64
+	Keys      uint64
+	Values    uint64
+	Count     uint32
+	MapFd     uint32
+	ElemFlags uint64
+	Flags     uint64
+}
+
+// batchDrainer holds the buffers of BPF_MAP_LOOKUP_AND_DELETE_BATCH calls
+// on a map. lookupAndDelete issues a call, it is replaced by the tests.
+type batchDrainer struct {
+	keySize         int
+	valueSize       int
+	cpus            int
+	count           int
+	mapFd           uint32
+	keys            []byte
+	values          []byte
+	inBatch         []byte
+	outBatch        []byte
+	lookupAndDelete func(attr *bpfBatchAttr) unix.Errno
+}
+
+// newBatchDrainer returns a drainer for a map of maxEntries entries. The
+// values of per-CPU maps are padded to 8 bytes for each of cpus.
+func newBatchDrainer(mapFd int, keySize int, valueSize int, maxEntries int, cpus int) *batchDrainer {
+	if cpus > 1 {
+		valueSize = ((valueSize + 7) &^ 7) * cpus
+	}
+	count := flowMapBatchSize
+	if maxEntries < count {
+		count = maxEntries
+	}
+	// The batch token of hash maps is a bucket index, other maps use a key
+	batchSize := keySize
+	if batchSize < 8 {
+		batchSize = 8
+	}
+	d := &batchDrainer{
+		keySize:   keySize,
+		valueSize: valueSize,
+		cpus:      cpus,
+		count:     count,
+		mapFd:     uint32(mapFd),
+		keys:      make([]byte, count*keySize),
+		values:    make([]byte, count*valueSize),
+		inBatch:   make([]byte, batchSize),
+		outBatch:  make([]byte, batchSize),
+	}
+	d.lookupAndDelete = d.syscall
+	return d
+}
+
+func (d *batchDrainer) syscall(attr *bpfBatchAttr) unix.Errno {
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfMapLookupAndDeleteBatch,
+		uintptr(unsafe.Pointer(attr)), unsafe.Sizeof(*attr))
+	runtime.KeepAlive(d.keys)
+	runtime.KeepAlive(d.values)
+	runtime.KeepAlive(d.inBatch)
+	runtime.KeepAlive(d.outBatch)
+	return errno
+}
+
+func (src *pinnedFlowMapSource) Drain(keyOut, valueOut interface{}, fn func()) error {
+	abi := src.ABI()
+	cpus := 1
+	if src.perCPU() {
+		var err error
+		if cpus, err = possibleCPUs(); err != nil {
+			return err
+		}
+	}
+	d := newBatchDrainer(src.FD(), int(abi.KeySize), int(abi.ValueSize), int(abi.MaxEntries), cpus)
+	return src.batch.drain(src.name, d, keyOut, valueOut, fn)
+}
+
+func (d *batchDrainer) drain(keyOut, valueOut interface{}, fn func()) error {
+	// The kernel writes the count of entries it read and deleted along with
+	// the next batch token, errors returned before reading any leave both
+	// untouched. No bucket index has all bits set.
+	unwritten := bytes.Repeat([]byte{0xff}, len(d.outBatch))
+	first := true
+	for {
+		copy(d.outBatch, unwritten)
+		attr := bpfBatchAttr{
+			OutBatch: uint64(uintptr(unsafe.Pointer(&d.outBatch[0]))),
+			Keys:     uint64(uintptr(unsafe.Pointer(&d.keys[0]))),
+			Values:   uint64(uintptr(unsafe.Pointer(&d.values[0]))),
+			Count:    uint32(d.count),
+			MapFd:    d.mapFd,
+		}
+		if !first {
+			attr.InBatch = uint64(uintptr(unsafe.Pointer(&d.inBatch[0])))
+		}
+		errno := d.lookupAndDelete(&attr)
+		if first && (errno == unix.EINVAL || errno == unix.EOPNOTSUPP || errno == errnoENOTSUPP) {
+			return ErrBatchNotSupported
+		}
+		read := int(attr.Count)
+		if bytes.Equal(d.outBatch, unwritten) {
+			read = 0
+		}
+		// Entries read before an error are already deleted, so they are
+		// passed to fn before the error is returned
+		for i := 0; i < read; i++ {
+			err := binary.Read(bytes.NewReader(d.keys[i*d.keySize:(i+1)*d.keySize]), binary.LittleEndian, keyOut)
+			if err != nil {
+				return err
+			}
+			err = decodeValue(d.values[i*d.valueSize:(i+1)*d.valueSize], d.cpus, valueOut)
+			if err != nil {
+				return err
+			}
+			fn()
+		}
+		if errno == unix.ENOENT {
+			return nil
+		}
+		if errno != 0 {
+			return errno
+		}
+		copy(d.inBatch, d.outBatch)
+		first = false
+	}
+}
+
+// decodeValue decodes the value of an entry, summing the values of each
+// CPU when there are several
+func decodeValue(value []byte, cpus int, valueOut interface{}) error {
+	if cpus == 1 {
+		return binary.Read(bytes.NewReader(value), binary.LittleEndian, valueOut)
+	}
+	stats, ok := valueOut.(*FlowStats)
+	if !ok {
+		return fmt.Errorf("cannot sum per-CPU values into %T", valueOut)
+	}
+	perCPUStats := make([]FlowStats, cpus)
+	stride := len(value) / cpus
+	for cpu := range perCPUStats {
+		err := binary.Read(bytes.NewReader(value[cpu*stride:(cpu+1)*stride]), binary.LittleEndian, &perCPUStats[cpu])
+		if err != nil {
+			return err
+		}
+	}
+	*stats = sumFlowStats(perCPUStats)
+	return nil
+}
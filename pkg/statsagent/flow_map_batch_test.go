@@ -0,0 +1,207 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"testing"
+	"unsafe"
+)
+
+func TestBpfBatchAttrLayout(t *testing.T) {
+	var attr bpfBatchAttr
+	// struct { ... } batch of union bpf_attr in include/uapi/linux/bpf.h
+	for _, tc := range []struct {
+		field  string
+		offset uintptr
+		want   uintptr
+	}{
+		{"in_batch", unsafe.Offsetof(attr.InBatch), 0},
+		{"out_batch", unsafe.Offsetof(attr.OutBatch), 8},
+		{"keys", unsafe.Offsetof(attr.Keys), 16},
+		{"values", unsafe.Offsetof(attr.Values), 24},
+		{"count", unsafe.Offsetof(attr.Count), 32},
+		{"map_fd", unsafe.Offsetof(attr.MapFd), 36},
+		{"elem_flags", unsafe.Offsetof(attr.ElemFlags), 40},
+		{"flags", unsafe.Offsetof(attr.Flags), 48},
+	} {
+		if tc.offset != tc.want {
+			t.Errorf("%s at offset %d, want %d", tc.field, tc.offset, tc.want)
+		}
+	}
+	if size := unsafe.Sizeof(attr); size != 56 {
+		t.Errorf("attr of %d bytes, want 56", size)
+	}
+}
+
+// testKernelBatches makes the drainer d return batches of uint32 keys,
+// whose values are the key times 10. ENOENT comes with the last batch,
+// like the kernel returns it, other errors with the call after it.
+func testKernelBatches(d *batchDrainer, batches [][]uint32, err unix.Errno) *[]bpfBatchAttr {
+	var calls []bpfBatchAttr
+	d.lookupAndDelete = func(attr *bpfBatchAttr) unix.Errno {
+		calls = append(calls, *attr)
+		i := len(calls) - 1
+		if i >= len(batches) {
+			return err
+		}
+		for j, key := range batches[i] {
+			binary.LittleEndian.PutUint32(d.keys[j*d.keySize:], key)
+			binary.LittleEndian.PutUint64(d.values[j*d.valueSize:], uint64(key)*10)
+		}
+		attr.Count = uint32(len(batches[i]))
+		binary.LittleEndian.PutUint64(d.outBatch, uint64(i))
+		if i == len(batches)-1 && err == unix.ENOENT {
+			return unix.ENOENT
+		}
+		return 0
+	}
+	return &calls
+}
+
+// drainTestKeys drains d and returns the keys it passed along with values
+// matching them
+func drainTestKeys(t *testing.T, d *batchDrainer) ([]uint32, error) {
+	var key uint32
+	var value uint64
+	var keys []uint32
+	err := d.drain(&key, &value, func() {
+		if value != uint64(key)*10 {
+			t.Errorf("key %d drained with value %d", key, value)
+		}
+		keys = append(keys, key)
+	})
+	return keys, err
+}
+
+func TestBatchDrainerReadsAllBatches(t *testing.T) {
+	d := newBatchDrainer(3, 4, 8, 2, 1)
+	calls := testKernelBatches(d, [][]uint32{{1, 2}, {3}}, unix.ENOENT)
+	keys, err := drainTestKeys(t, d)
+	if err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if len(keys) != 3 || keys[0] != 1 || keys[1] != 2 || keys[2] != 3 {
+		t.Errorf("drained keys %v, want [1 2 3]", keys)
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("%d batch calls, want 2", len(*calls))
+	}
+	first, second := (*calls)[0], (*calls)[1]
+	if first.InBatch != 0 || second.InBatch == 0 {
+		t.Errorf("in_batch %x then %x, want none then the token", first.InBatch, second.InBatch)
+	}
+	if first.Count != 2 || first.MapFd != 3 {
+		t.Errorf("first call for %d entries of map %d, want 2 of map 3", first.Count, first.MapFd)
+	}
+}
+
+func TestBatchDrainerPassesEntriesBeforeError(t *testing.T) {
+	d := newBatchDrainer(3, 4, 8, 2, 1)
+	testKernelBatches(d, [][]uint32{{1, 2}}, unix.EFAULT)
+	keys, err := drainTestKeys(t, d)
+	if err != unix.EFAULT {
+		t.Errorf("drain returned %v, want EFAULT", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("drained keys %v, want the 2 deleted before the error", keys)
+	}
+}
+
+func TestBatchSupportIsPerMap(t *testing.T) {
+	support := newBatchSupport()
+	var key uint32
+	var value uint64
+	rejected := newBatchDrainer(3, 4, 8, 2, 1)
+	rejected.lookupAndDelete = func(attr *bpfBatchAttr) unix.Errno {
+		return unix.EINVAL
+	}
+	err := support.drain("v4_flow_map", rejected, &key, &value, func() {})
+	if err != ErrBatchNotSupported {
+		t.Fatalf("rejected drain returned %v, want ErrBatchNotSupported", err)
+	}
+
+	calls := 0
+	d := newBatchDrainer(4, 4, 8, 2, 1)
+	d.lookupAndDelete = func(attr *bpfBatchAttr) unix.Errno {
+		calls++
+		return unix.ENOENT
+	}
+	if err = support.drain("v4_flow_map_1", d, &key, &value, func() {}); err != nil {
+		t.Errorf("drain of another map returned %v", err)
+	}
+	if err = support.drain("v4_flow_map", d, &key, &value, func() {}); err != ErrBatchNotSupported {
+		t.Errorf("drain of the rejected map returned %v, want ErrBatchNotSupported", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d batch calls, want 1 for the other map", calls)
+	}
+}
+
+// drainFailingSource drains n entries of a MemFlowMapSource in a batch,
+// then fails with err
+type drainFailingSource struct {
+	*MemFlowMapSource
+	n   int
+	err error
+}
+
+func (src *drainFailingSource) Drain(keyOut, valueOut interface{}, fn func()) error {
+	iter := src.Iterate()
+	for i := 0; i < src.n && iter.Next(keyOut, valueOut); i++ {
+		src.Delete(keyOut)
+		fn()
+	}
+	return src.err
+}
+
+func TestUpdateStatsFallsBackFromBatchDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		err  error
+	}{
+		{"not supported", 0, ErrBatchNotSupported},
+		{"failed after a batch", 1, unix.EFAULT},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, maps := newTestAgent()
+			agent.SetFlowMapOpener(func(mapName string) (FlowMapSource, error) {
+				return &drainFailingSource{maps.Map(mapName), tc.n, tc.err}, nil
+			})
+			metric := NewInetV4FlowMetricsEntry(agent)
+			now := monotonicNow()
+			for _, port := range []uint16{40000, 40001} {
+				maps.Map("v4_flow_map").Put(testV4Flow(testClientIp, port, testServerIp, 80), FlowStats{
+					Out_bytes: 100, Out_packets: 1, First_seen_ns: now, Last_seen_ns: now,
+				})
+			}
+			metric.UpdateStats()
+
+			if n := maps.Map("v4_flow_map").Len(); n != 0 {
+				t.Errorf("drained buffer holds %d flows, want 0", n)
+			}
+			client, ok := metric.podStatsMap[testPodKey("default/client")]
+			if !ok {
+				t.Fatal("no stats for the client pod")
+			}
+			if client.Stats.Out_bytes != 200 || client.Stats.Out_packets != 2 {
+				t.Errorf("client out %d bytes %d packets, want 200 and 2",
+					client.Stats.Out_bytes, client.Stats.Out_packets)
+			}
+		})
+	}
+}
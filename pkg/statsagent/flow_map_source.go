@@ -0,0 +1,296 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"fmt"
+	"github.com/cilium/ebpf"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// FlowMapSource is the map a FlowMetricsEntry reads flow counters from.
+// Keys and values follow the conventions of ebpf.Map: keys are FlowKey
+// structs (or pointers to them) and values are decoded into pointers.
+type FlowMapSource interface {
+	Iterate() FlowMapIterator
+	Lookup(key, valueOut interface{}) error
+	Put(key, value interface{}) error
+	Delete(key interface{}) error
+	Close() error
+}
+
+// FlowMapIterator walks the entries of a FlowMapSource, see ebpf.MapIterator
+type FlowMapIterator interface {
+	Next(keyOut, valueOut interface{}) bool
+	Err() error
+}
+
+// FlowMapOpener returns the FlowMapSource backing the named map
+type FlowMapOpener func(mapName string) (FlowMapSource, error)
+
+type pinnedFlowMapSource struct {
+	*ebpf.Map
+	name  string
+	batch *batchSupport
+}
+
+// perCPU reports whether the map holds a value per CPU. The ebpf package
+// only knows the values of per-CPU hash maps to be per CPU, the values of
+// per-CPU LRU hash maps are decoded here.
+func (src *pinnedFlowMapSource) perCPU() bool {
+	t := src.ABI().Type
+	return t == ebpf.PerCPUHash || t == ebpf.LRUCPUHash
+}
+
+// perCPUBuffer returns a buffer for the values of every CPU of an entry,
+// each padded to 8 bytes, and the number of CPUs
+func (src *pinnedFlowMapSource) perCPUBuffer() ([]byte, int, error) {
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return nil, 0, err
+	}
+	return make([]byte, ((int(src.ABI().ValueSize)+7)&^7)*cpus), cpus, nil
+}
+
+func (src *pinnedFlowMapSource) Iterate() FlowMapIterator {
+	if !src.perCPU() {
+		return src.Map.Iterate()
+	}
+	buf, cpus, err := src.perCPUBuffer()
+	return &perCPUFlowMapIterator{MapIterator: src.Map.Iterate(), buf: buf, cpus: cpus, err: err}
+}
+
+func (src *pinnedFlowMapSource) Lookup(key, valueOut interface{}) error {
+	if !src.perCPU() {
+		return src.Map.Lookup(key, valueOut)
+	}
+	buf, cpus, err := src.perCPUBuffer()
+	if err != nil {
+		return err
+	}
+	if err = src.Map.Lookup(key, unsafe.Pointer(&buf[0])); err != nil {
+		return err
+	}
+	return decodeValue(buf, cpus, valueOut)
+}
+
+// perCPUFlowMapIterator sums the values of each CPU into a FlowStats
+type perCPUFlowMapIterator struct {
+	*ebpf.MapIterator
+	buf  []byte
+	cpus int
+	err  error
+}
+
+func (iter *perCPUFlowMapIterator) Next(keyOut, valueOut interface{}) bool {
+	if iter.err != nil || !iter.MapIterator.Next(keyOut, unsafe.Pointer(&iter.buf[0])) {
+		return false
+	}
+	iter.err = decodeValue(iter.buf, iter.cpus, valueOut)
+	return iter.err == nil
+}
+
+func (iter *perCPUFlowMapIterator) Err() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.MapIterator.Err()
+}
+
+func sumFlowStats(perCPUStats []FlowStats) FlowStats {
+	var stats FlowStats
+	for i := range perCPUStats {
+		addFlowStats(&stats, &perCPUStats[i])
+	}
+	return stats
+}
+
+// possibleCPUs returns the number of CPUs a per-CPU map holds values for
+func possibleCPUs() (int, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+	var low, high int
+	spec := strings.TrimSpace(string(data))
+	n, _ := fmt.Sscanf(spec, "%d-%d", &low, &high)
+	switch {
+	case n == 2 && low == 0:
+		return high + 1, nil
+	case n == 1 && low == 0 && !strings.Contains(spec, "-"):
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unsupported possible CPUs %q", spec)
+}
+
+// NewPinnedFlowMapOpener opens maps pinned under config.EbpfMapDir. The
+// directory is looked up on every open since the environment may
+// rewrite it after the agent is created. Maps whose batch operations the
+// kernel rejected once are drained one key at a time from then on.
+func NewPinnedFlowMapOpener(config *StatsAgentConfig) FlowMapOpener {
+	batch := newBatchSupport()
+	return func(mapName string) (FlowMapSource, error) {
+		m, err := ebpf.LoadPinnedMap(config.EbpfMapDir + "/" + mapName)
+		if err != nil {
+			return nil, err
+		}
+		return &pinnedFlowMapSource{Map: m, name: mapName, batch: batch}, nil
+	}
+}
+
+// MemFlowMapSource is an in-memory FlowMapSource. Flow counters are
+// scripted into it with Put, so the aggregation, aging and Prometheus
+// logic can be driven without root or a loaded BPF object.
+type MemFlowMapSource struct {
+	mutex   sync.Mutex
+	entries map[interface{}]interface{}
+}
+
+func NewMemFlowMapSource() *MemFlowMapSource {
+	return &MemFlowMapSource{
+		entries: make(map[interface{}]interface{}),
+	}
+}
+
+// memValue dereferences pointers so that entries are stored by value
+func memValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		return rv.Elem().Interface()
+	}
+	return v
+}
+
+// Put creates or overwrites the entry for key
+func (src *MemFlowMapSource) Put(key, value interface{}) error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.entries[memValue(key)] = memValue(value)
+	return nil
+}
+
+func (src *MemFlowMapSource) Lookup(key, valueOut interface{}) error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	k := memValue(key)
+	v, ok := src.entries[k]
+	if !ok {
+		return fmt.Errorf("key %v does not exist", k)
+	}
+	return memCopy(valueOut, v)
+}
+
+func (src *MemFlowMapSource) Delete(key interface{}) error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	k := memValue(key)
+	if _, ok := src.entries[k]; !ok {
+		return fmt.Errorf("key %v does not exist", k)
+	}
+	delete(src.entries, k)
+	return nil
+}
+
+// Len returns the number of entries in the map
+func (src *MemFlowMapSource) Len() int {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	return len(src.entries)
+}
+
+// Iterate walks a snapshot of the map, so entries may be changed or
+// deleted while iterating.
+func (src *MemFlowMapSource) Iterate() FlowMapIterator {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	iter := &memFlowMapIterator{}
+	for k, v := range src.entries {
+		iter.keys = append(iter.keys, k)
+		iter.values = append(iter.values, v)
+	}
+	return iter
+}
+
+func (src *MemFlowMapSource) Close() error {
+	return nil
+}
+
+type memFlowMapIterator struct {
+	keys   []interface{}
+	values []interface{}
+	next   int
+	err    error
+}
+
+func memCopy(dst, src interface{}) error {
+	dv := reflect.ValueOf(dst)
+	sv := reflect.ValueOf(src)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Type() != sv.Type() {
+		return fmt.Errorf("cannot decode %T into %T", src, dst)
+	}
+	dv.Elem().Set(sv)
+	return nil
+}
+
+func (iter *memFlowMapIterator) Next(keyOut, valueOut interface{}) bool {
+	if iter.err != nil || iter.next >= len(iter.keys) {
+		return false
+	}
+	if iter.err = memCopy(keyOut, iter.keys[iter.next]); iter.err != nil {
+		return false
+	}
+	if iter.err = memCopy(valueOut, iter.values[iter.next]); iter.err != nil {
+		return false
+	}
+	iter.next++
+	return true
+}
+
+func (iter *memFlowMapIterator) Err() error {
+	return iter.err
+}
+
+// MemFlowMapSet is a named collection of MemFlowMapSources. Its Open
+// method can be installed with StatsAgent.SetFlowMapOpener.
+type MemFlowMapSet struct {
+	mutex sync.Mutex
+	maps  map[string]*MemFlowMapSource
+}
+
+func NewMemFlowMapSet() *MemFlowMapSet {
+	return &MemFlowMapSet{
+		maps: make(map[string]*MemFlowMapSource),
+	}
+}
+
+// Map returns the named map, creating it if needed
+func (set *MemFlowMapSet) Map(mapName string) *MemFlowMapSource {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	src, ok := set.maps[mapName]
+	if !ok {
+		src = NewMemFlowMapSource()
+		set.maps[mapName] = src
+	}
+	return src
+}
+
+func (set *MemFlowMapSet) Open(mapName string) (FlowMapSource, error) {
+	return set.Map(mapName), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+// testPerCPUStats are the values of a flow on three CPUs, the second of
+// which saw none of its packets
+var testPerCPUStats = []FlowStats{
+	{
+		Out_bytes: 100, Out_packets: 2, In_bytes: 40, In_packets: 1,
+		First_seen_ns: 50, Last_seen_ns: 60,
+		Tcp_flags_out: tcpFlagSyn, Syn_count: 1,
+	},
+	{},
+	{
+		Out_bytes: 20, Out_packets: 1, In_bytes: 300, In_packets: 3,
+		First_seen_ns: 40, Last_seen_ns: 70,
+		Tcp_flags_in: tcpFlagFin, Fin_count: 1, In_frag_packets: 2,
+	},
+}
+
+func checkPerCPUSum(t *testing.T, stats FlowStats) {
+	if stats.Out_bytes != 120 || stats.Out_packets != 3 || stats.In_bytes != 340 || stats.In_packets != 4 {
+		t.Errorf("summed counters %+v", stats)
+	}
+	if stats.Syn_count != 1 || stats.Fin_count != 1 || stats.In_frag_packets != 2 {
+		t.Errorf("summed TCP and fragment counters %+v", stats)
+	}
+	// The earliest first seen of the CPUs that saw the flow, and the
+	// latest last seen
+	if stats.First_seen_ns != 40 || stats.Last_seen_ns != 70 {
+		t.Errorf("flow seen from %d to %d, want 40 to 70", stats.First_seen_ns, stats.Last_seen_ns)
+	}
+	if stats.Tcp_flags_out != tcpFlagSyn || stats.Tcp_flags_in != tcpFlagFin {
+		t.Errorf("flags out %x in %x, want %x and %x", stats.Tcp_flags_out, stats.Tcp_flags_in, tcpFlagSyn, tcpFlagFin)
+	}
+}
+
+func TestSumFlowStatsOfEachCPU(t *testing.T) {
+	checkPerCPUSum(t, sumFlowStats(testPerCPUStats))
+}
+
+func TestDecodePerCPUValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i := range testPerCPUStats {
+		if err := binary.Write(buf, binary.LittleEndian, &testPerCPUStats[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stats FlowStats
+	if err := decodeValue(buf.Bytes(), len(testPerCPUStats), &stats); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	checkPerCPUSum(t, stats)
+
+	var other uint64
+	if err := decodeValue(buf.Bytes(), len(testPerCPUStats), &other); err == nil {
+		t.Error("per-CPU values decoded into a counter")
+	}
+}
+
+func TestBatchDrainerSumsPerCPUValues(t *testing.T) {
+	valueSize := binary.Size(FlowStats{})
+	d := newBatchDrainer(3, 4, valueSize, 1, len(testPerCPUStats))
+	d.lookupAndDelete = func(attr *bpfBatchAttr) unix.Errno {
+		binary.LittleEndian.PutUint32(d.keys, 7)
+		buf := new(bytes.Buffer)
+		for i := range testPerCPUStats {
+			binary.Write(buf, binary.LittleEndian, &testPerCPUStats[i])
+			// Each CPU value is padded to 8 bytes
+			buf.Write(make([]byte, (valueSize+7)&^7-valueSize))
+		}
+		copy(d.values, buf.Bytes())
+		attr.Count = 1
+		binary.LittleEndian.PutUint64(d.outBatch, 0)
+		return unix.ENOENT
+	}
+	var key uint32
+	var stats FlowStats
+	drained := 0
+	err := d.drain(&key, &stats, func() {
+		drained++
+		if key != 7 {
+			t.Errorf("drained key %d, want 7", key)
+		}
+		checkPerCPUSum(t, stats)
+	})
+	if err != nil || drained != 1 {
+		t.Errorf("drained %d flows with error %v, want 1", drained, err)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The flow maps are double buffered: the kernel counts into mapName or
+// mapName_1 as selected by the entry selIndex of flowMapSelName.
+const (
+	flowMapSelName        = "flow_map_sel"
+	flowMapSelV4   uint32 = 0
+	flowMapSelV6   uint32 = 1
+)
+
+// Time given to programs that selected a flow map before a swap to finish
+// updating it. This is a heuristic: a program preempted for longer may
+// still update the old buffer while it is drained. An update to a flow
+// not yet drained is read, one to a flow already drained re-creates it for
+// the next drain of that buffer, and one between the read and the delete
+// of a flow is lost.
+const flowMapSwapGrace = 100 * time.Millisecond
+
+// FlowMetricsEntry aggregates the counters of a pinned flow map into
+// pod, service and pod to service stats. The map key layout is supplied
+// through newKey, so any FlowKey implementation matching the kernel
+// struct can be plugged in.
+type FlowMetricsEntry struct {
+	mapName         string
+	ipFamily        string
+	selIndex        uint32
+	newKey          func() FlowKey
+	baseMap         map[interface{}]*FlowStatsEntry
+	legacyBaseMap   map[interface{}]FlowStats
+	overflowBaseMap map[overflowKey]*FlowStatsEntry
+	interval        int
+	lastDrops       uint64
+	dropsRead       bool
+	podStatsMap     map[PodStatsKey]*FlowStatsEntry
+	svcStatsMap     map[PodStatsKey]*FlowStatsEntry
+	knownStatsMap   map[PodStatsKey]*FlowStatsEntry
+	svcDsts         map[interface{}]svcDst
+	icmpStats       map[string]*icmpCounts
+	connRates       map[string]bool
+	lastScan        time.Time
+	agent           *StatsAgent
+	stateMutex      sync.Mutex
+	// scanMutex serializes the scans, which release stateMutex while the
+	// kernel finishes with the buffer they swapped out
+	scanMutex sync.Mutex
+	// closedFlows holds the TCP flows finalized on their close until
+	// they idle out, so that the packets following the close do not
+	// make them flows again
+	closedFlows map[interface{}]*FlowStatsEntry
+	// newConns counts the connections opened to each destination address
+	// since the last scan, it is updated by flow events under eventMutex
+	newConns    map[string]uint64
+	lastTrigger time.Time
+	trigger     chan struct{}
+	eventMutex  sync.Mutex
+}
+
+func NewFlowMetricsEntry(agent *StatsAgent, mapName string, ipFamily string, selIndex uint32,
+	newKey func() FlowKey) *FlowMetricsEntry {
+	return &FlowMetricsEntry{
+		mapName:         mapName,
+		ipFamily:        ipFamily,
+		selIndex:        selIndex,
+		newKey:          newKey,
+		baseMap:         make(map[interface{}]*FlowStatsEntry),
+		closedFlows:     make(map[interface{}]*FlowStatsEntry),
+		overflowBaseMap: make(map[overflowKey]*FlowStatsEntry),
+		podStatsMap:     make(map[PodStatsKey]*FlowStatsEntry),
+		svcStatsMap:     make(map[PodStatsKey]*FlowStatsEntry),
+		knownStatsMap:   make(map[PodStatsKey]*FlowStatsEntry),
+		icmpStats:       make(map[string]*icmpCounts),
+		connRates:       make(map[string]bool),
+		newConns:        make(map[string]uint64),
+		trigger:         make(chan struct{}, 1),
+		agent:           agent,
+		interval:        agent.config.StatsInterval,
+	}
+}
+
+// flowKeyValue returns the struct a FlowKey points to, so that it can be
+// used as a comparable map key and marshalled back to the kernel.
+func flowKeyValue(key FlowKey) interface{} {
+	return reflect.ValueOf(key).Elem().Interface()
+}
+
+func (metric *FlowMetricsEntry) GetStats() {
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	for k, v := range metric.podStatsMap {
+		fmt.Printf("%s<->%s Out:%d bytes %d packets In: %d bytes %d packets, duration:%v\n",
+			k.Endpoints[0], k.Endpoints[1], v.Stats.Out_bytes, v.Stats.Out_packets, v.Stats.In_bytes, v.Stats.In_packets,
+			v.Stats.Duration())
+	}
+}
+
+// Run adopts the state saved by a previous agent before the first scan,
+// once the Prometheus subsystems are registered.
+func (metric *FlowMetricsEntry) Run(stopCh <-chan struct{}) {
+	if err := metric.restoreState(); err != nil {
+		metric.agent.log.Error("Failed to restore state for ", metric.mapName, ": ", err)
+	}
+	metric.setFillThreshold()
+	metric.setNewEvents()
+	metric.lastScan = time.Now()
+	runMetric(metric, stopCh)
+}
+
+// GetStatsInterval returns the interval adapted to the last scan, see
+// adaptInterval
+func (metric *FlowMetricsEntry) GetStatsInterval() int {
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	return metric.interval
+}
+
+func (metric *FlowMetricsEntry) Init() {
+	metric.agent.log.Debug("Setting channel to kickoff stats for ", metric.mapName)
+}
+
+// addStats accumulates stats for a single endpoint key, which is either
+// a pod or a service depending on isSvc, and refreshes its gauge.
+func (metric *FlowMetricsEntry) addStats(isSvc bool, podStatsKey PodStatsKey, stats *FlowStats, t *time.Time) {
+	statsMap := metric.podStatsMap
+	if isSvc {
+		statsMap = metric.svcStatsMap
+	}
+	if _, cok := statsMap[podStatsKey]; !cok {
+		statsMap[podStatsKey] = &FlowStatsEntry{}
+	}
+	statsMap[podStatsKey].add(stats, t)
+	promMetricsKey := podStatsKey.toPromMetricsKey(metric.agent, metric.ipFamily)
+	if isSvc {
+		metric.agent.SetSvcGauge(promMetricsKey, &statsMap[podStatsKey].Stats)
+	} else {
+		metric.agent.SetPodGauge(promMetricsKey, &statsMap[podStatsKey].Stats)
+	}
+	metric.agent.SetConnGauges(promMetricsKey, &statsMap[podStatsKey].Stats)
+}
+
+func (metric *FlowMetricsEntry) mergeStats(keyType int, podStatsKey PodStatsKey, stats *FlowStats, t *time.Time) {
+	switch keyType {
+	case FROM_POD_KEY, TO_POD_KEY, FROM_SVC_KEY, TO_SVC_KEY,
+		FROM_POD_KEY | TO_POD_KEY, FROM_SVC_KEY | TO_SVC_KEY,
+		FROM_POD_KEY | TO_SVC_KEY, FROM_SVC_KEY | TO_POD_KEY:
+	default:
+		return
+	}
+	copiedStats := *stats
+	if keyType&(FROM_POD_KEY|FROM_SVC_KEY) != 0 {
+		srcStatsKey := podStatsKey
+		(&srcStatsKey).clear(1)
+		metric.addStats(keyType&FROM_SVC_KEY != 0, srcStatsKey, &copiedStats, t)
+	}
+	if keyType&(TO_POD_KEY|TO_SVC_KEY) != 0 {
+		dstStatsKey := podStatsKey
+		(&dstStatsKey).swap()
+		(&dstStatsKey).clear(1)
+		(&copiedStats).swap()
+		metric.addStats(keyType&TO_SVC_KEY != 0, dstStatsKey, &copiedStats, t)
+	}
+	if keyType == FROM_POD_KEY|TO_SVC_KEY || keyType == FROM_SVC_KEY|TO_POD_KEY {
+		if _, cok := metric.knownStatsMap[podStatsKey]; !cok {
+			metric.knownStatsMap[podStatsKey] = &FlowStatsEntry{}
+		}
+		metric.knownStatsMap[podStatsKey].add(&copiedStats, t)
+		promMetricsKey := podStatsKey.toPromMetricsKey(metric.agent, metric.ipFamily)
+		metric.agent.SetPodSvcGauge(promMetricsKey, &metric.knownStatsMap[podStatsKey].Stats)
+	}
+}
+
+func (metric *FlowMetricsEntry) idleTimeout() time.Duration {
+	return time.Duration(metric.agent.config.FlowIdleTimeout) * time.Second
+}
+
+// ageStatsMap returns the keys that have seen no traffic for longer than
+// the idle timeout at the scan at t, now being the kernel time of t.
+func (metric *FlowMetricsEntry) ageStatsMap(statsMap map[PodStatsKey]*FlowStatsEntry, now uint64, t time.Time) []PodStatsKey {
+	var toDeleteList []PodStatsKey
+	for k, v := range statsMap {
+		idle := v.idleFor(now, t)
+		if idle > metric.idleTimeout() {
+			toDeleteList = append(toDeleteList, k)
+		}
+		metric.agent.log.Debugf("%s<->%s Out:%d bytes %d packets In: %d bytes %d packets, idle:%v",
+			k.Endpoints[0], k.Endpoints[1], v.Stats.Out_bytes, v.Stats.Out_packets, v.Stats.In_bytes, v.Stats.In_packets,
+			idle)
+	}
+	return toDeleteList
+}
+
+// unreachableSvcKeys returns the keys of services that were deleted or
+// lost the external, load balancer or node port address they were reached
+// at, so that their series go right away instead of once idle
+func (metric *FlowMetricsEntry) unreachableSvcKeys(statsMap map[PodStatsKey]*FlowStatsEntry) []PodStatsKey {
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	var toDeleteList []PodStatsKey
+	for k := range statsMap {
+		if !metric.agent.svcReachable(k.Endpoints[0]) || !metric.agent.svcReachable(k.Endpoints[1]) {
+			toDeleteList = append(toDeleteList, k)
+		}
+	}
+	return toDeleteList
+}
+
+// deleteStatsKeys forgets the keys and deletes their series, so that the
+// labels of pods, services and backends that are gone do not pile up
+func (metric *FlowMetricsEntry) deleteStatsKeys(statsMap map[PodStatsKey]*FlowStatsEntry, toDeleteList []PodStatsKey) {
+	for _, toDelete := range toDeleteList {
+		metric.agent.log.Debug("Deleting podStatsKey", toDelete.Endpoints[0], "->", toDelete.Endpoints[1])
+		delete(statsMap, toDelete)
+		promMetricsKey := toDelete.toPromMetricsKey(metric.agent, metric.ipFamily)
+		metric.agent.DeletePodGauge(promMetricsKey)
+		metric.agent.DeleteSvcGauge(promMetricsKey)
+		metric.agent.DeletePodSvcGauge(promMetricsKey)
+		metric.agent.DeleteConnGauges(promMetricsKey)
+	}
+}
+
+func (metric *FlowMetricsEntry) flowMapName(buffer uint32) string {
+	if buffer == 0 {
+		return metric.mapName
+	}
+	return metric.mapName + "_1"
+}
+
+// swapFlowMaps switches the kernel to the other buffer of the flow map and
+// returns the buffer it stopped counting into, once the grace period has
+// passed. It is called without stateMutex so that flow events are handled
+// meanwhile.
+func (metric *FlowMetricsEntry) swapFlowMaps() (uint32, error) {
+	sel, err := metric.agent.flowMapOpener(flowMapSelName)
+	if err != nil {
+		return 0, err
+	}
+	defer sel.Close()
+	var active uint32
+	if err = sel.Lookup(metric.selIndex, &active); err == nil && active != 0 {
+		active = 1
+	} else {
+		active = 0
+	}
+	if err = sel.Put(metric.selIndex, 1-active); err != nil {
+		return 0, err
+	}
+	time.Sleep(flowMapSwapGrace)
+	return active, nil
+}
+
+// ageFlows forgets the flows that have seen no traffic for longer than
+// the idle timeout, with their original destinations. The duration of
+// flows that were not closed is recorded as they age out, closed flows
+// had theirs recorded on the close.
+func (metric *FlowMetricsEntry) ageFlows(now uint64, t time.Time) {
+	var aged []interface{}
+	keyOut := metric.newKey()
+	for k, v := range metric.baseMap {
+		if v.idleFor(now, t) > metric.idleTimeout() {
+			reflect.ValueOf(keyOut).Elem().Set(reflect.ValueOf(k))
+			podStatsKey, keyType := metric.podStatsKey(keyOut)
+			metric.observeDuration(keyType, podStatsKey, v.Stats.Duration(), metric.agent.ObserveFlowDuration)
+			delete(metric.baseMap, k)
+			aged = append(aged, k)
+		}
+	}
+	for k, v := range metric.closedFlows {
+		if v.idleFor(now, t) > metric.idleTimeout() {
+			delete(metric.closedFlows, k)
+			aged = append(aged, k)
+		}
+	}
+	metric.deleteSvcDsts(aged)
+}
+
+// iterateAndDelete drains m one key at a time, for kernels without batch
+// map operations
+func (metric *FlowMetricsEntry) iterateAndDelete(m FlowMapSource, drainName string,
+	keyOut FlowKey, valueOut *FlowStats, fn func()) {
+	mIter := m.Iterate()
+	var drainedList []interface{}
+	for mIter.Next(keyOut, valueOut) {
+		drainedList = append(drainedList, flowKeyValue(keyOut))
+		fn()
+	}
+	if err := mIter.Err(); err != nil {
+		// Entries not read stay in the buffer until it is drained again
+		metric.agent.log.Error("Failed to iterate ", drainName, ": ", err)
+	}
+	for _, key := range drainedList {
+		if err := m.Delete(key); err != nil {
+			metric.agent.log.Error("Failed to delete from ", drainName, ": ", err)
+		}
+	}
+}
+
+// addFlow adds the counters drained from a flow map buffer to the flow and
+// to the stats of its endpoints
+func (metric *FlowMetricsEntry) addFlow(keyOut FlowKey, valueOut *FlowStats, t *time.Time) {
+	key := flowKeyValue(keyOut)
+	stats := *valueOut
+	if baseStats, ok := metric.legacyBaseMap[key]; ok {
+		stats = *diffFlowStats(&baseStats, valueOut)
+	}
+	if closed, ok := metric.closedFlows[key]; ok && stats.Syn_count == 0 {
+		// ACKs and retransmits following the close only count for
+		// the endpoints
+		closed.add(&stats, t)
+	} else {
+		delete(metric.closedFlows, key)
+		if _, ok := metric.baseMap[key]; !ok {
+			metric.baseMap[key] = &FlowStatsEntry{}
+		}
+		metric.baseMap[key].add(&stats, t)
+	}
+	podStatsKey, keyType := metric.podStatsKey(keyOut)
+	metric.mergeStats(keyType, podStatsKey, &stats, t)
+	metric.countIcmp(keyOut, keyType, podStatsKey, &stats)
+}
+
+// UpdateStats swaps the flow map buffers and drains the inactive one, so
+// every counter is read exactly once and nothing the kernel adds during
+// the scan is lost. The resulting state is saved, so that a restarted
+// agent resumes from this scan.
+func (metric *FlowMetricsEntry) UpdateStats() {
+	metric.scanMutex.Lock()
+	defer metric.scanMutex.Unlock()
+	buffer, err := metric.swapFlowMaps()
+	if err != nil {
+		metric.agent.log.Error("Failed to swap ", metric.mapName, ": ", err)
+		return
+	}
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	drainName := metric.flowMapName(buffer)
+	metric.svcDsts = metric.readSvcDsts()
+	metric.agent.log.Debug("Draining map ", drainName)
+	m, err := metric.agent.flowMapOpener(drainName)
+	if err != nil {
+		metric.agent.log.Error(err)
+		return
+	}
+	t := time.Now()
+	keyOut := metric.newKey()
+	var valueOut FlowStats
+	entries := 0
+	addFlow := func() {
+		entries++
+		metric.addFlow(keyOut, &valueOut, &t)
+	}
+	drained := false
+	if drainer, ok := m.(FlowMapDrainer); ok {
+		err = drainer.Drain(keyOut, &valueOut, addFlow)
+		if err == nil {
+			drained = true
+		} else if err != ErrBatchNotSupported {
+			metric.agent.log.Error("Failed to batch drain ", drainName, ": ", err)
+		}
+	}
+	if !drained {
+		metric.iterateAndDelete(m, drainName, keyOut, &valueOut, addFlow)
+	}
+	metric.agent.SetScanGauges(metric.mapName, metric.ipFamily, time.Since(t), entries)
+	metric.adaptInterval(metric.updatePressure(m, entries))
+	m.Close()
+	metric.resetFlowCount(buffer)
+	metric.updateConnRates(t)
+	metric.ageIcmpStats()
+	metric.legacyBaseMap = nil
+	now := monotonicNow()
+	metric.updateOverflowStats(now, t)
+	metric.ageFlows(now, t)
+	metric.deleteStatsKeys(metric.knownStatsMap, metric.ageStatsMap(metric.knownStatsMap, now, t))
+	metric.deleteStatsKeys(metric.podStatsMap, metric.ageStatsMap(metric.podStatsMap, now, t))
+	metric.deleteStatsKeys(metric.svcStatsMap, metric.ageStatsMap(metric.svcStatsMap, now, t))
+	metric.deleteStatsKeys(metric.knownStatsMap, metric.unreachableSvcKeys(metric.knownStatsMap))
+	metric.deleteStatsKeys(metric.svcStatsMap, metric.unreachableSvcKeys(metric.svcStatsMap))
+	if err = metric.saveState(); err != nil {
+		metric.agent.log.Error("Failed to save state for ", metric.mapName, ": ", err)
+	}
+}
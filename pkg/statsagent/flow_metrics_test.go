@@ -0,0 +1,559 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"encoding/binary"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/bits"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testClientIp = "10.0.0.1"
+	testServerIp = "10.0.0.2"
+	testSvcIp    = "10.96.0.10"
+	testIdle     = 60
+)
+
+// newTestAgent returns an agent reading its flow maps from the returned
+// MemFlowMapSet, with a client pod, a server pod and a service
+func newTestAgent() (*StatsAgent, *MemFlowMapSet) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := &StatsAgentConfig{
+		StatsInterval:   10,
+		FlowIdleTimeout: testIdle,
+	}
+	agent := NewStatsAgent(config, log, nil)
+	maps := NewMemFlowMapSet()
+	agent.SetFlowMapOpener(maps.Open)
+	agent.registerPrometheusMetrics()
+	agent.podIpToName[testClientIp] = "default/client"
+	agent.podIpToName[testServerIp] = "default/server"
+	agent.podInfo["default/client"] = PodInfo{PodIPs: []string{testClientIp}}
+	agent.podInfo["default/server"] = PodInfo{PodIPs: []string{testServerIp}}
+	agent.svcIpToName[testSvcIp] = "default/web"
+	agent.svcInfo["default/web"] = SvcInfo{ClusterIPs: []string{testSvcIp}, SvcType: "ClusterIP"}
+	return agent, maps
+}
+
+// testV4Flow returns the key of a TCP flow from src to the local pod dst,
+// addresses and ports in network order like the kernel keys
+func testV4Flow(src string, sport uint16, dst string, dport uint16) inet_v4_flow {
+	return inet_v4_flow{
+		Src_ip: binary.LittleEndian.Uint32(net.ParseIP(src).To4()),
+		Dst_ip: binary.LittleEndian.Uint32(net.ParseIP(dst).To4()),
+		L4: proto_port{
+			Ip_proto: ipProtoTcp,
+			Sport:    bits.ReverseBytes16(sport),
+			Dport:    bits.ReverseBytes16(dport),
+		},
+	}
+}
+
+func testPodKey(podName string) PodStatsKey {
+	return PodStatsKey{Endpoints: [2]string{podName, ""}, Proto: protoTcp}
+}
+
+func activeBuffer(t *testing.T, maps *MemFlowMapSet) uint32 {
+	var active uint32
+	if err := maps.Map(flowMapSelName).Lookup(flowMapSelV4, &active); err != nil {
+		t.Fatalf("no active buffer: %v", err)
+	}
+	return active
+}
+
+func TestUpdateStatsDrainsBuffers(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	now := monotonicNow()
+
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 100, Out_packets: 2, In_bytes: 300, In_packets: 3,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+	if active := activeBuffer(t, maps); active != 1 {
+		t.Fatalf("active buffer after the first scan is %d, want 1", active)
+	}
+	if n := maps.Map("v4_flow_map").Len(); n != 0 {
+		t.Fatalf("drained buffer holds %d flows, want 0", n)
+	}
+
+	// The kernel now counts into the other buffer, from zero
+	maps.Map("v4_flow_map_1").Put(key, FlowStats{
+		Out_bytes: 50, Out_packets: 1, In_bytes: 10, In_packets: 1,
+		First_seen_ns: now + 1, Last_seen_ns: now + 2,
+	})
+	metric.UpdateStats()
+	if active := activeBuffer(t, maps); active != 0 {
+		t.Fatalf("active buffer after the second scan is %d, want 0", active)
+	}
+	if n := maps.Map("v4_flow_map_1").Len(); n != 0 {
+		t.Fatalf("drained buffer holds %d flows, want 0", n)
+	}
+
+	flow, ok := metric.baseMap[key]
+	if !ok {
+		t.Fatal("flow not tracked")
+	}
+	if flow.Stats.Out_bytes != 150 || flow.Stats.In_bytes != 310 {
+		t.Errorf("flow bytes out %d in %d, want 150 and 310", flow.Stats.Out_bytes, flow.Stats.In_bytes)
+	}
+	if flow.Stats.First_seen_ns != now || flow.Stats.Last_seen_ns != now+2 {
+		t.Errorf("flow seen from %d to %d, want %d to %d",
+			flow.Stats.First_seen_ns, flow.Stats.Last_seen_ns, now, now+2)
+	}
+
+	// Out counts what the local pod received, so the client sent it
+	client, ok := metric.podStatsMap[testPodKey("default/client")]
+	if !ok {
+		t.Fatal("no stats for the client pod")
+	}
+	if client.Stats.Out_bytes != 150 || client.Stats.Out_packets != 3 ||
+		client.Stats.In_bytes != 310 || client.Stats.In_packets != 4 {
+		t.Errorf("client stats %+v", client.Stats)
+	}
+	server, ok := metric.podStatsMap[testPodKey("default/server")]
+	if !ok {
+		t.Fatal("no stats for the server pod")
+	}
+	if server.Stats.In_bytes != 150 || server.Stats.Out_bytes != 310 {
+		t.Errorf("server bytes out %d in %d, want 310 and 150", server.Stats.Out_bytes, server.Stats.In_bytes)
+	}
+}
+
+func TestUpdateStatsAttributesServices(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	key := testV4Flow(testSvcIp, 80, testClientIp, 40000)
+	now := monotonicNow()
+
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 1000, Out_packets: 4, In_bytes: 200, In_packets: 2,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+
+	svcKey := PodStatsKey{
+		Endpoints: [2]string{svcEndpoint("default/web", "ClusterIP", SvcAccessClusterIP), "default/client"},
+		Proto:     protoTcp,
+	}
+	known, ok := metric.knownStatsMap[svcKey]
+	if !ok {
+		t.Fatalf("no service to pod stats, have %v", metric.knownStatsMap)
+	}
+	if known.Stats.Out_bytes != 200 || known.Stats.In_bytes != 1000 {
+		t.Errorf("service to pod bytes out %d in %d, want 200 and 1000", known.Stats.Out_bytes, known.Stats.In_bytes)
+	}
+	promKey := svcKey.toPromMetricsKey(agent, metric.ipFamily)
+	if promKey.metricName != "svc_pod_stats" || promKey.svcName[0] != "web" ||
+		promKey.svcAccess[0] != SvcAccessClusterIP || promKey.podName[0] != "client" {
+		t.Errorf("service to pod labels %+v", promKey)
+	}
+	svc, ok := metric.svcStatsMap[PodStatsKey{Endpoints: [2]string{svcKey.Endpoints[0], ""}, Proto: protoTcp}]
+	if !ok || svc.Stats.Out_bytes != 1000 {
+		t.Errorf("service stats %+v", svc)
+	}
+}
+
+func TestUpdateStatsKeepsClientOfBackend(t *testing.T) {
+	agent, maps := newTestAgent()
+	agent.config.BackendClientLabels = true
+	metric := NewInetV4FlowMetricsEntry(agent)
+	agent.backendToSvc[backendKey(protoTcp, testServerIp, "80")] = "default/web"
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	now := monotonicNow()
+
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 100, Out_packets: 1, In_bytes: 500, In_packets: 2,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+
+	svcKey := PodStatsKey{
+		Endpoints: [2]string{svcEndpoint("default/web", "ClusterIP", ""), "default/server"},
+		Proto:     protoTcp,
+		Side:      SvcSideBackend,
+		Client:    "default/client",
+	}
+	if _, ok := metric.knownStatsMap[svcKey]; !ok {
+		t.Fatalf("no service to backend stats, have %v", metric.knownStatsMap)
+	}
+	promKey := svcKey.toPromMetricsKey(agent, metric.ipFamily)
+	if promKey.svcSide != SvcSideBackend || promKey.clientName != "client" || promKey.podName[0] != "server" {
+		t.Errorf("service to backend labels %+v", promKey)
+	}
+	if _, ok := metric.podStatsMap[testPodKey("default/server")]; !ok {
+		t.Error("no stats for the backend pod")
+	}
+}
+
+func TestUpdateStatsAggregatesClientsOfBackend(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	agent.backendToSvc[backendKey(protoTcp, testServerIp, "80")] = "default/web"
+	agent.podIpToName["10.0.0.3"] = "default/client2"
+	now := monotonicNow()
+
+	for _, clientIp := range []string{testClientIp, "10.0.0.3"} {
+		maps.Map("v4_flow_map").Put(testV4Flow(clientIp, 40000, testServerIp, 80), FlowStats{
+			Out_bytes: 100, Out_packets: 1, First_seen_ns: now, Last_seen_ns: now,
+		})
+	}
+	metric.UpdateStats()
+
+	if len(metric.knownStatsMap) != 1 {
+		t.Fatalf("%d service to backend keys, want one for all clients", len(metric.knownStatsMap))
+	}
+	svcKey := PodStatsKey{
+		Endpoints: [2]string{svcEndpoint("default/web", "ClusterIP", ""), "default/server"},
+		Proto:     protoTcp,
+		Side:      SvcSideBackend,
+	}
+	known, ok := metric.knownStatsMap[svcKey]
+	if !ok {
+		t.Fatalf("no service to backend stats, have %v", metric.knownStatsMap)
+	}
+	if known.Stats.In_bytes != 200 {
+		t.Errorf("backend received %d bytes, want 200", known.Stats.In_bytes)
+	}
+}
+
+func TestUpdateStatsAgesIdleFlows(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	now := monotonicNow()
+	idle := uint64(2 * testIdle * time.Second)
+	if now <= idle {
+		t.Skip("monotonic clock too recent to fake an idle flow")
+	}
+	idleKey := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	activeKey := testV4Flow(testClientIp, 40001, testServerIp, 443)
+	maps.Map("v4_flow_map").Put(idleKey, FlowStats{
+		Out_bytes: 100, Out_packets: 1,
+		First_seen_ns: now - idle - 1, Last_seen_ns: now - idle,
+	})
+	maps.Map("v4_flow_map").Put(activeKey, FlowStats{
+		Out_bytes: 100, Out_packets: 1,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+
+	if _, ok := metric.baseMap[idleKey]; ok {
+		t.Error("idle flow not aged out")
+	}
+	if _, ok := metric.baseMap[activeKey]; !ok {
+		t.Error("active flow aged out")
+	}
+	// The pods keep the last seen time of their most recent flow
+	if _, ok := metric.podStatsMap[testPodKey("default/client")]; !ok {
+		t.Error("client pod of the active flow aged out")
+	}
+
+	// Once the active flow has been idle as long, the pods age out too
+	metric.baseMap[activeKey].Stats.Last_seen_ns = now - idle
+	metric.podStatsMap[testPodKey("default/client")].Stats.Last_seen_ns = now - idle
+	metric.podStatsMap[testPodKey("default/server")].Stats.Last_seen_ns = now - idle
+	metric.UpdateStats()
+	if len(metric.baseMap) != 0 {
+		t.Errorf("%d flows left after aging", len(metric.baseMap))
+	}
+	if len(metric.podStatsMap) != 0 {
+		t.Errorf("%d pods left after aging", len(metric.podStatsMap))
+	}
+}
+
+// histogramSamples returns the sample count and sum of a histogram
+func histogramSamples(t *testing.T, agent *StatsAgent, subsystem string, name string,
+	labels prometheus.Labels) (uint64, float64) {
+	observer, err := agent.promSubsystems[subsystem].GetHistogramVec(name).GetMetricWith(labels)
+	if err != nil {
+		t.Fatalf("no %s %s histogram: %v", subsystem, name, err)
+	}
+	var m dto.Metric
+	if err = observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestUpdateStatsObservesFlowDuration(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	now := monotonicNow()
+	idle := uint64(2 * testIdle * time.Second)
+	if now <= idle+uint64(2*time.Second) {
+		t.Skip("monotonic clock too recent to fake an idle flow")
+	}
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 100, Out_packets: 2,
+		First_seen_ns: now - idle - uint64(2*time.Second), Last_seen_ns: now - idle,
+	})
+	metric.UpdateStats()
+
+	count, sum := histogramSamples(t, agent, "pod_conn_stats", FlowDurationHistogram, prometheus.Labels{
+		"pod_namespace": "default", "pod_name": "client", "protocol": protoTcp, "ip_family": "ipv4",
+	})
+	if count != 1 || sum != 2 {
+		t.Errorf("client flow durations %d samples summing to %vs, want 1 of 2s", count, sum)
+	}
+	count, _ = histogramSamples(t, agent, "pod_conn_stats", ConnDurationHistogram, prometheus.Labels{
+		"pod_namespace": "default", "pod_name": "client", "ip_family": "ipv4",
+	})
+	if count != 0 {
+		t.Errorf("flow that aged out recorded as %d closed connections", count)
+	}
+}
+
+func testCloseEvent(key inet_v4_flow, buffer uint32, tcpFlags uint32) *flowEvent {
+	return &flowEvent{
+		Type:      flowEventClose,
+		Family:    flowMapSelV4,
+		Src_ip:    [4]uint32{key.Src_ip},
+		Dst_ip:    [4]uint32{key.Dst_ip},
+		L4:        key.L4,
+		Buffer:    buffer,
+		Tcp_flags: tcpFlags,
+	}
+}
+
+func TestFinalizeFlowAcrossSwaps(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	now := monotonicNow()
+
+	// The client closes its side, the flags move to the agent
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 100, Out_packets: 3, Tcp_flags_out: tcpFlagSyn | tcpFlagAck | tcpFlagFin,
+		Syn_count: 1, Fin_count: 1, First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.handleFlowEvent(testCloseEvent(key, 0, tcpFlagFin|tcpFlagAck))
+	if _, ok := metric.baseMap[key]; !ok {
+		t.Fatal("half closed flow finalized")
+	}
+	if n := maps.Map("v4_flow_map").Len(); n != 0 {
+		t.Fatalf("buffer holds %d flows after the first FIN, want 0", n)
+	}
+
+	// The server closes its side after a swap
+	metric.UpdateStats()
+	maps.Map("v4_flow_map_1").Put(key, FlowStats{
+		In_bytes: 40, In_packets: 1, Tcp_flags_in: tcpFlagAck | tcpFlagFin,
+		Fin_count: 1, First_seen_ns: now + 1, Last_seen_ns: now + 1,
+	})
+	metric.handleFlowEvent(testCloseEvent(key, 1, tcpFlagFin|tcpFlagAck))
+	if _, ok := metric.baseMap[key]; ok {
+		t.Fatal("closed flow not finalized")
+	}
+	if _, ok := metric.closedFlows[key]; !ok {
+		t.Fatal("closed flow not kept")
+	}
+
+	// The last ACK and a retransmitted FIN only count for the pods
+	maps.Map("v4_flow_map_1").Put(key, FlowStats{
+		Out_bytes: 40, Out_packets: 1, Tcp_flags_out: tcpFlagAck | tcpFlagFin,
+		Fin_count: 1, First_seen_ns: now + 2, Last_seen_ns: now + 2,
+	})
+	metric.handleFlowEvent(testCloseEvent(key, 1, tcpFlagFin|tcpFlagAck))
+	metric.UpdateStats()
+	if _, ok := metric.baseMap[key]; ok {
+		t.Error("closed flow inserted again")
+	}
+	client := metric.podStatsMap[testPodKey("default/client")]
+	if client == nil || client.Stats.Out_packets != 4 || client.Stats.In_packets != 1 {
+		t.Errorf("client stats %+v", client)
+	}
+}
+
+func testNewEvent(key inet_v4_flow) *flowEvent {
+	event := testCloseEvent(key, 0, tcpFlagSyn)
+	event.Type = flowEventNew
+	return event
+}
+
+func TestNewConnectionRates(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		agent, maps := newTestAgent()
+		agent.config.FlowNewEvents = enabled
+		metric := NewInetV4FlowMetricsEntry(agent)
+		metric.setNewEvents()
+		var config uint64
+		if err := maps.Map(flowConfigName).Lookup(uint32(flowConfigNewEvents), &config); err != nil {
+			t.Fatal(err)
+		}
+		if (config != 0) != enabled {
+			t.Errorf("new flow events configured as %d with --flow-new-events=%v", config, enabled)
+		}
+	}
+
+	agent, _ := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	for sport := uint16(40000); sport < 40003; sport++ {
+		metric.handleFlowEvent(testNewEvent(testV4Flow(testClientIp, sport, testServerIp, 80)))
+	}
+	// Connections to addresses that are not local pods are not counted
+	metric.handleFlowEvent(testNewEvent(testV4Flow(testServerIp, 40000, "10.0.0.9", 80)))
+	metric.lastScan = time.Now().Add(-10 * time.Second)
+	metric.UpdateStats()
+
+	gauge, err := agent.promSubsystems["pod_conn_stats"].GetGaugeVec("new_connections_per_second").
+		GetMetricWith(podConnLabels("default/server", "ipv4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dto.Metric
+	if err = gauge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if rate := m.GetGauge().GetValue(); rate <= 0 || rate > 0.3 {
+		t.Errorf("server opened %v connections per second, want 3 in over 10s", rate)
+	}
+	if len(metric.connRates) != 1 || !metric.connRates["default/server"] {
+		t.Errorf("connection rates exported for %v, want default/server", metric.connRates)
+	}
+}
+
+// gaugeSeries returns the number of series of a gauge
+func gaugeSeries(agent *StatsAgent, subsystem string, name string) int {
+	ch := make(chan prometheus.Metric, 16)
+	go func() {
+		agent.promSubsystems[subsystem].GetGaugeVec(name).Collect(ch)
+		close(ch)
+	}()
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
+
+func TestUpdateStatsDeletesAgedSeries(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	now := monotonicNow()
+	idle := uint64(2 * testIdle * time.Second)
+	if now <= idle {
+		t.Skip("monotonic clock too recent to fake an idle flow")
+	}
+	maps.Map("v4_flow_map").Put(testV4Flow(testSvcIp, 80, testClientIp, 40000), FlowStats{
+		Out_bytes: 1000, Out_packets: 4, In_bytes: 200, In_packets: 2, Syn_count: 1,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+	series := []struct {
+		subsystem string
+		name      string
+	}{
+		{"pod_stats", "pod_tx_bytes"},
+		{"svc_stats", "svc_tx_bytes"},
+		{"pod_svc_stats", "pod_to_svc_bytes"},
+		{"pod_conn_stats", "connection_attempts"},
+		{"svc_conn_stats", "connection_attempts"},
+	}
+	for _, s := range series {
+		if gaugeSeries(agent, s.subsystem, s.name) != 1 {
+			t.Fatalf("no %s %s series", s.subsystem, s.name)
+		}
+	}
+
+	for _, entry := range metric.baseMap {
+		entry.Stats.Last_seen_ns = now - idle
+	}
+	for _, statsMap := range []map[PodStatsKey]*FlowStatsEntry{
+		metric.podStatsMap, metric.svcStatsMap, metric.knownStatsMap,
+	} {
+		for _, entry := range statsMap {
+			entry.Stats.Last_seen_ns = now - idle
+		}
+	}
+	metric.UpdateStats()
+	for _, s := range series {
+		if n := gaugeSeries(agent, s.subsystem, s.name); n != 0 {
+			t.Errorf("%d %s %s series left after aging", n, s.subsystem, s.name)
+		}
+	}
+}
+
+func TestUpdateStatsDeletesUnreachableSvcSeries(t *testing.T) {
+	agent, maps := newTestAgent()
+	metric := NewInetV4FlowMetricsEntry(agent)
+	agent.serviceUpdated(testLoadBalancer("lb"))
+	now := monotonicNow()
+	maps.Map("v4_flow_map").Put(testV4Flow("192.168.1.50", 80, testClientIp, 40000), FlowStats{
+		Out_bytes: 1000, Out_packets: 4, In_bytes: 200, In_packets: 2,
+		First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+	if gaugeSeries(agent, "svc_stats", "svc_tx_bytes") != 1 || gaugeSeries(agent, "pod_svc_stats", "pod_to_svc_bytes") != 1 {
+		t.Fatal("no series of the service reached at its external address")
+	}
+
+	// The external address is dropped long before the flow would idle
+	svc := testLoadBalancer("lb")
+	svc.Spec.ExternalIPs = nil
+	agent.serviceUpdated(svc)
+	metric.UpdateStats()
+	if n := gaugeSeries(agent, "svc_stats", "svc_tx_bytes"); n != 0 {
+		t.Errorf("%d svc_stats series left", n)
+	}
+	if n := gaugeSeries(agent, "pod_svc_stats", "pod_to_svc_bytes"); n != 0 {
+		t.Errorf("%d pod_svc_stats series left", n)
+	}
+	if len(metric.svcStatsMap) != 0 || len(metric.knownStatsMap) != 0 {
+		t.Errorf("kept %d service and %d pod to service keys", len(metric.svcStatsMap), len(metric.knownStatsMap))
+	}
+}
+
+func TestApplySvcDstBackendLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		backendIp   string
+		wantBackend string
+	}{
+		{"backend pod", testServerIp, "default/server"},
+		// Addresses are unbounded, only pods are labelled
+		{"backend outside the cluster", "192.168.1.20", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, _ := newTestAgent()
+			metric := NewInetV4FlowMetricsEntry(agent)
+			key := testV4Flow(tc.backendIp, 80, testClientIp, 40000)
+			metric.svcDsts = map[interface{}]svcDst{
+				key: {
+					Svc_ip:     [4]uint32{testV4Flow(testSvcIp, 0, testSvcIp, 0).Src_ip},
+					Backend_ip: [4]uint32{key.Src_ip},
+					Svc_port:   portValue(80),
+				},
+			}
+			podStatsKey, keyType := metric.podStatsKey(&key)
+			if keyType != FROM_SVC_KEY|TO_POD_KEY {
+				t.Fatalf("flow of type %d not attributed to the service", keyType)
+			}
+			if podStatsKey.Backend != tc.wantBackend {
+				t.Errorf("backend %q, want %q", podStatsKey.Backend, tc.wantBackend)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"fmt"
+	"time"
+)
+
+// When a flow map is full the kernel counts the failed insert in
+// flow_errors and accounts the packet to the cgroup of its socket in
+// flow_overflow_map. The indexes of flow_errors are the family indexes of
+// flowMapSelName for failed flow map inserts, and flowErrOverflow above
+// them for failed overflow map inserts.
+const (
+	flowErrorsName      = "flow_errors"
+	flowErrOverflow     = 2
+	flowOverflowMapName = "flow_overflow_map"
+)
+
+// Fill ratio of a flow map above which the status shows a warning
+const flowMapFillWarning = 0.9
+
+// Fill ratios above which the scan interval is shortened and below which
+// it is lengthened
+const (
+	flowMapFillHigh = 0.5
+	flowMapFillLow  = 0.1
+)
+
+type overflowKey struct {
+	Cgroup_id uint64
+	Family    uint32
+	Padding   uint32
+}
+
+// flowMapCapacity is implemented by FlowMapSources with a fixed size
+type flowMapCapacity interface {
+	MaxEntries() uint32
+}
+
+func (src *pinnedFlowMapSource) MaxEntries() uint32 {
+	return src.ABI().MaxEntries
+}
+
+// readFlowErrors sums the per-CPU counter at index of flow_errors
+func (metric *FlowMetricsEntry) readFlowErrors(errors FlowMapSource, index uint32) (uint64, error) {
+	var perCPUCounts []uint64
+	if err := errors.Lookup(index, &perCPUCounts); err != nil {
+		return 0, err
+	}
+	var count uint64
+	for _, c := range perCPUCounts {
+		count += c
+	}
+	return count, nil
+}
+
+// updatePressure exports how full the drained buffer m was and how many
+// inserts the kernel dropped, and warns in the status when the flow map
+// is close to or past its capacity. It returns the fill ratio and whether
+// inserts were dropped since the last scan.
+func (metric *FlowMetricsEntry) updatePressure(m FlowMapSource, entries int) (float64, bool) {
+	var fillRatio float64
+	if capacity, ok := m.(flowMapCapacity); ok && capacity.MaxEntries() > 0 {
+		fillRatio = float64(entries) / float64(capacity.MaxEntries())
+	}
+	errors, err := metric.agent.flowMapOpener(flowErrorsName)
+	if err != nil {
+		metric.agent.log.Debug("Not reading flow errors: ", err)
+		return fillRatio, false
+	}
+	defer errors.Close()
+	drops, err := metric.readFlowErrors(errors, metric.selIndex)
+	if err != nil {
+		metric.agent.log.Debug("Not reading flow errors: ", err)
+		return fillRatio, false
+	}
+	overflowDrops, err := metric.readFlowErrors(errors, flowErrOverflow+metric.selIndex)
+	if err != nil {
+		metric.agent.log.Debug("Not reading flow errors: ", err)
+		return fillRatio, false
+	}
+	metric.agent.SetMapPressureGauges(metric.mapName, metric.ipFamily, fillRatio, drops, overflowDrops)
+
+	dropped := metric.dropsRead && drops > metric.lastDrops
+	var warning string
+	switch {
+	case dropped:
+		warning = fmt.Sprintf("%s is full, %d flow inserts dropped since the last scan",
+			metric.mapName, drops-metric.lastDrops)
+	case fillRatio >= flowMapFillWarning:
+		warning = fmt.Sprintf("%s is %.0f%% full", metric.mapName, fillRatio*100)
+	}
+	if warning != "" {
+		metric.agent.log.Warn(warning)
+	}
+	metric.agent.setWarning(metric.mapName, warning)
+	metric.lastDrops = drops
+	metric.dropsRead = true
+	return fillRatio, dropped
+}
+
+// adaptInterval halves the scan interval when the flow map fills up and
+// doubles it back toward the configured interval when the node is quiet
+func (metric *FlowMetricsEntry) adaptInterval(fillRatio float64, dropped bool) {
+	minInterval, maxInterval := metric.agent.config.statsIntervalBounds()
+	switch {
+	case dropped || fillRatio >= flowMapFillHigh:
+		metric.interval /= 2
+	case fillRatio < flowMapFillLow:
+		metric.interval *= 2
+	}
+	if metric.interval < minInterval {
+		metric.interval = minInterval
+	}
+	if metric.interval > maxInterval {
+		metric.interval = maxInterval
+	}
+	metric.agent.SetScanIntervalGauge(metric.mapName, metric.ipFamily, metric.interval)
+}
+
+// updateOverflowStats adds the traffic accounted to cgroups since the last
+// scan to the stats of their pods. The overflow map is cumulative, so it
+// is diffed against the values of the last scan and idle entries are
+// deleted.
+func (metric *FlowMetricsEntry) updateOverflowStats(now uint64, t time.Time) {
+	m, err := metric.agent.flowMapOpener(flowOverflowMapName)
+	if err != nil {
+		metric.agent.log.Debug("Not reading overflow stats: ", err)
+		return
+	}
+	defer m.Close()
+	var key overflowKey
+	var value FlowStats
+	var toDeleteList []overflowKey
+	mIter := m.Iterate()
+	for mIter.Next(&key, &value) {
+		if key.Family != metric.selIndex {
+			continue
+		}
+		base, ok := metric.overflowBaseMap[key]
+		if !ok {
+			base = &FlowStatsEntry{}
+			metric.overflowBaseMap[key] = base
+		}
+		diffStats := diffFlowStats(&base.Stats, &value)
+		if diffStats.Out_packets+diffStats.In_packets != 0 {
+			base.TimeStamp = t
+		}
+		base.Stats = value
+		if base.idleFor(now, t) > metric.idleTimeout() {
+			toDeleteList = append(toDeleteList, key)
+		}
+		if diffStats.Out_packets+diffStats.In_packets == 0 {
+			continue
+		}
+		podName, ok := metric.agent.cgroupPod(key.Cgroup_id)
+		if !ok {
+			metric.agent.log.Debug("No pod for overflow cgroup ", key.Cgroup_id)
+			continue
+		}
+		// Like flows the overflow stats count what the pod received as
+		// out, so swap them as mergeStats does for the destination pod
+		diffStats.swap()
+		metric.addStats(false, PodStatsKey{Endpoints: [2]string{podName, ""}}, diffStats, &t)
+	}
+	if err = mIter.Err(); err != nil {
+		metric.agent.log.Error("Failed to iterate ", flowOverflowMapName, ": ", err)
+	}
+	for _, toDelete := range toDeleteList {
+		if err = m.Delete(toDelete); err != nil {
+			metric.agent.log.Error("Failed to delete from ", flowOverflowMapName, ": ", err)
+		}
+		delete(metric.overflowBaseMap, toDelete)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The state of a FlowMetricsEntry is saved after every scan so that the
+// next agent resumes the per-flow records and the pod and service totals
+// instead of starting again from zero.
+
+// Version 0 saved the cumulative counters of the single buffered flow
+// maps, which are baselines to subtract from their first drain.
+const flowStateVersion = 1
+
+type flowState struct {
+	Key   []byte    `json:"key"`
+	Stats FlowStats `json:"stats"`
+}
+
+type podStatsState struct {
+	Key   PodStatsKey `json:"key"`
+	Stats FlowStats   `json:"stats"`
+}
+
+type overflowState struct {
+	Key   overflowKey `json:"key"`
+	Stats FlowStats   `json:"stats"`
+}
+
+type flowMetricsState struct {
+	Version    int             `json:"version"`
+	Flows      []flowState     `json:"flows,omitempty"`
+	PodStats   []podStatsState `json:"pod-stats,omitempty"`
+	SvcStats   []podStatsState `json:"svc-stats,omitempty"`
+	KnownStats []podStatsState `json:"known-stats,omitempty"`
+	Overflow   []overflowState `json:"overflow,omitempty"`
+}
+
+func (metric *FlowMetricsEntry) statePath() string {
+	return filepath.Join(metric.agent.config.StateDir, metric.mapName+".json")
+}
+
+func toPodStatsState(statsMap map[PodStatsKey]*FlowStatsEntry) []podStatsState {
+	var states []podStatsState
+	for k, v := range statsMap {
+		states = append(states, podStatsState{Key: k, Stats: v.Stats})
+	}
+	return states
+}
+
+// saveState writes the state atomically, the caller holds stateMutex
+func (metric *FlowMetricsEntry) saveState() error {
+	if metric.agent.config.StateDir == "" {
+		return nil
+	}
+	state := flowMetricsState{
+		Version:    flowStateVersion,
+		PodStats:   toPodStatsState(metric.podStatsMap),
+		SvcStats:   toPodStatsState(metric.svcStatsMap),
+		KnownStats: toPodStatsState(metric.knownStatsMap),
+	}
+	for k, v := range metric.overflowBaseMap {
+		state.Overflow = append(state.Overflow, overflowState{Key: k, Stats: v.Stats})
+	}
+	for k, v := range metric.baseMap {
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.LittleEndian, k); err != nil {
+			return err
+		}
+		state.Flows = append(state.Flows, flowState{Key: buf.Bytes(), Stats: v.Stats})
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(metric.agent.config.StateDir, 0700); err != nil {
+		return err
+	}
+	tmpPath := metric.statePath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, metric.statePath())
+}
+
+func (metric *FlowMetricsEntry) restoreStatsMap(statsMap map[PodStatsKey]*FlowStatsEntry,
+	states []podStatsState, t time.Time, setGauge func(*PromMetricsKey, *FlowStats)) {
+	for _, s := range states {
+		statsMap[s.Key] = &FlowStatsEntry{Stats: s.Stats, TimeStamp: t}
+		setGauge(s.Key.toPromMetricsKey(metric.agent, metric.ipFamily), &statsMap[s.Key].Stats)
+	}
+}
+
+// restoreState adopts the state saved by a previous agent. Baselines of a
+// version 0 state are only adopted if the pinned map they refer to was
+// reused. A state that cannot be decoded, of an unknown version or with
+// flow keys of another size is rejected as a whole.
+func (metric *FlowMetricsEntry) restoreState() error {
+	if metric.agent.config.StateDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(metric.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state flowMetricsState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version < 0 || state.Version > flowStateVersion {
+		return fmt.Errorf("Unsupported state version %d", state.Version)
+	}
+	var flowKeys []interface{}
+	for _, f := range state.Flows {
+		keyOut := metric.newKey()
+		if len(f.Key) != binary.Size(keyOut) {
+			return fmt.Errorf("Flow key of %d bytes, want %d", len(f.Key), binary.Size(keyOut))
+		}
+		if err = binary.Read(bytes.NewReader(f.Key), binary.LittleEndian, keyOut); err != nil {
+			return err
+		}
+		flowKeys = append(flowKeys, flowKeyValue(keyOut))
+	}
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	t := time.Now()
+	metric.restoreStatsMap(metric.podStatsMap, state.PodStats, t, metric.agent.SetPodGauge)
+	metric.restoreStatsMap(metric.svcStatsMap, state.SvcStats, t, metric.agent.SetSvcGauge)
+	metric.restoreStatsMap(metric.knownStatsMap, state.KnownStats, t, metric.agent.SetPodSvcGauge)
+	if metric.agent.bpfLoader == nil || metric.agent.bpfLoader.MapReused(flowOverflowMapName) {
+		for _, o := range state.Overflow {
+			metric.overflowBaseMap[o.Key] = &FlowStatsEntry{Stats: o.Stats, TimeStamp: t}
+		}
+	}
+	legacy := state.Version == 0
+	if legacy && metric.agent.bpfLoader != nil && !metric.agent.bpfLoader.MapReused(metric.mapName) {
+		metric.agent.log.Info("Not adopting flow baselines for recreated map ", metric.mapName)
+		return nil
+	}
+	if legacy {
+		metric.legacyBaseMap = make(map[interface{}]FlowStats)
+	}
+	for i, f := range state.Flows {
+		if legacy {
+			metric.legacyBaseMap[flowKeys[i]] = f.Stats
+		} else {
+			metric.baseMap[flowKeys[i]] = &FlowStatsEntry{Stats: f.Stats, TimeStamp: t}
+		}
+	}
+	metric.agent.log.Info("Adopted ", len(state.Flows), " flows for ", metric.mapName)
+	return nil
+}
+
+// removeStates removes the state saved for all flow maps
+func (agent *StatsAgent) removeStates() {
+	if agent.config.StateDir == "" {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(agent.config.StateDir, "*.json"))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			agent.log.Error("Failed to remove state ", path, ": ", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestStateAgent returns a test agent saving its state in dir
+func newTestStateAgent(dir string) (*StatsAgent, *MemFlowMapSet) {
+	agent, maps := newTestAgent()
+	agent.config.StateDir = dir
+	return agent, maps
+}
+
+func tempStateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "statsagent-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testStateJSON(t *testing.T, state flowMetricsState) []byte {
+	data, err := json.Marshal(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeTestState saves data as the state of the IPv4 flow map
+func writeTestState(t *testing.T, dir string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "v4_flow_map.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFlowKeyBytes(t *testing.T, key inet_v4_flow) []byte {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, key); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRestoreStateResumesCounters(t *testing.T) {
+	dir := tempStateDir(t)
+	defer os.RemoveAll(dir)
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	now := monotonicNow()
+
+	agent, maps := newTestStateAgent(dir)
+	metric := NewInetV4FlowMetricsEntry(agent)
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 100, Out_packets: 1, First_seen_ns: now, Last_seen_ns: now,
+	})
+	metric.UpdateStats()
+
+	// The next agent only finds what the kernel counted since the last
+	// drain in the flow maps
+	agent, maps = newTestStateAgent(dir)
+	metric = NewInetV4FlowMetricsEntry(agent)
+	if err := metric.restoreState(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	maps.Map("v4_flow_map").Put(key, FlowStats{
+		Out_bytes: 50, Out_packets: 1, First_seen_ns: now + 1, Last_seen_ns: now + 1,
+	})
+	metric.UpdateStats()
+
+	flow, ok := metric.baseMap[key]
+	if !ok {
+		t.Fatal("flow not restored")
+	}
+	if flow.Stats.Out_bytes != 150 || flow.Stats.Out_packets != 2 {
+		t.Errorf("flow out %d bytes %d packets, want 150 and 2", flow.Stats.Out_bytes, flow.Stats.Out_packets)
+	}
+	client, ok := metric.podStatsMap[testPodKey("default/client")]
+	if !ok {
+		t.Fatal("no stats for the client pod")
+	}
+	if client.Stats.Out_bytes != 150 || client.Stats.Out_packets != 2 {
+		t.Errorf("client out %d bytes %d packets, want 150 and 2", client.Stats.Out_bytes, client.Stats.Out_packets)
+	}
+}
+
+func TestRestoreStateLegacyBaselines(t *testing.T) {
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	now := monotonicNow()
+	for _, tc := range []struct {
+		name     string
+		reused   bool
+		outBytes uint64
+	}{
+		// The baseline is subtracted from the counter it was read from
+		{"reused map", true, 50},
+		// A recreated map counts from zero, it has no baseline
+		{"recreated map", false, 150},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempStateDir(t)
+			defer os.RemoveAll(dir)
+			writeTestState(t, dir, testStateJSON(t, flowMetricsState{
+				Version: 0,
+				Flows: []flowState{{
+					Key:   testFlowKeyBytes(t, key),
+					Stats: FlowStats{Out_bytes: 100, First_seen_ns: now, Last_seen_ns: now},
+				}},
+			}))
+			agent, maps := newTestStateAgent(dir)
+			agent.bpfLoader = NewBpfLoader(agent.config, agent.log)
+			agent.bpfLoader.reused["v4_flow_map"] = tc.reused
+			metric := NewInetV4FlowMetricsEntry(agent)
+			if err := metric.restoreState(); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+			maps.Map("v4_flow_map").Put(key, FlowStats{
+				Out_bytes: 150, First_seen_ns: now, Last_seen_ns: now + 1,
+			})
+			metric.UpdateStats()
+
+			flow, ok := metric.baseMap[key]
+			if !ok {
+				t.Fatal("flow not tracked")
+			}
+			if flow.Stats.Out_bytes != tc.outBytes {
+				t.Errorf("flow out %d bytes, want %d", flow.Stats.Out_bytes, tc.outBytes)
+			}
+		})
+	}
+}
+
+func TestRestoreStateRejectsInvalid(t *testing.T) {
+	key := testV4Flow(testClientIp, 40000, testServerIp, 80)
+	podStats := []podStatsState{{Key: testPodKey("default/client"), Stats: FlowStats{Out_bytes: 100}}}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"corrupt", []byte(`{"version": 1, "flows": [`)},
+		{"future version", testStateJSON(t, flowMetricsState{Version: flowStateVersion + 1, PodStats: podStats})},
+		{"flow key size", testStateJSON(t, flowMetricsState{
+			Version:  flowStateVersion,
+			Flows:    []flowState{{Key: testFlowKeyBytes(t, key)[:4]}},
+			PodStats: podStats,
+		})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempStateDir(t)
+			defer os.RemoveAll(dir)
+			writeTestState(t, dir, tc.data)
+			agent, _ := newTestStateAgent(dir)
+			metric := NewInetV4FlowMetricsEntry(agent)
+			if err := metric.restoreState(); err == nil {
+				t.Fatal("state restored")
+			}
+			if len(metric.podStatsMap) != 0 || len(metric.baseMap) != 0 {
+				t.Errorf("adopted %d pods and %d flows of a rejected state",
+					len(metric.podStatsMap), len(metric.baseMap))
+			}
+		})
+	}
+}
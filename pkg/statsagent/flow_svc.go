@@ -0,0 +1,207 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The connect and sendmsg programs record the destination of every socket
+// before kube-proxy translates it. When a flow is inserted in a flow map
+// the kernel copies the destination of its socket to the svc map of the
+// family, keyed like the flow map.
+
+// svcDst matches struct svc_dst
+type svcDst struct {
+	Svc_ip     [4]uint32
+	Backend_ip [4]uint32
+	Svc_port   uint16
+	Padding    uint16
+}
+
+// ipString formats an address of a key or value, v4 addresses only use
+// the first word
+func ipString(ip [4]uint32, v4 bool) string {
+	buf := new(bytes.Buffer)
+	if v4 {
+		binary.Write(buf, binary.LittleEndian, ip[0])
+	} else {
+		binary.Write(buf, binary.LittleEndian, ip)
+	}
+	return net.IP(buf.Bytes()).String()
+}
+
+func (metric *FlowMetricsEntry) flowSvcMapName() string {
+	return strings.TrimSuffix(metric.mapName, "_map") + "_svc_map"
+}
+
+// readSvcDsts returns the original destinations of the flows. Entries
+// are deleted when their flow ends, see deleteSvcDsts, a flow inserted
+// again records its destination again.
+func (metric *FlowMetricsEntry) readSvcDsts() map[interface{}]svcDst {
+	if metric.agent.config.ServiceResolution == ServiceResolutionConntrack {
+		return metric.readConntrackSvcDsts()
+	}
+	svcDsts := make(map[interface{}]svcDst)
+	m, err := metric.agent.flowMapOpener(metric.flowSvcMapName())
+	if err != nil {
+		metric.agent.log.Debug("Not reading service destinations: ", err)
+		return svcDsts
+	}
+	defer m.Close()
+	keyOut := metric.newKey()
+	var sd svcDst
+	mIter := m.Iterate()
+	for mIter.Next(keyOut, &sd) {
+		svcDsts[flowKeyValue(keyOut)] = sd
+	}
+	if err = mIter.Err(); err != nil {
+		// Evictions during the walk end it early, the flows not read
+		// are keyed by their addresses only
+		metric.agent.log.Debug("Failed to iterate ", metric.flowSvcMapName(), ": ", err)
+	}
+	return svcDsts
+}
+
+// lookupSvcDst reads the original destination of a flow that ends before
+// the next scan reads them all. The conntrack table is only dumped by
+// scans.
+func (metric *FlowMetricsEntry) lookupSvcDst(keyOut FlowKey) {
+	if metric.agent.config.ServiceResolution == ServiceResolutionConntrack {
+		return
+	}
+	key := flowKeyValue(keyOut)
+	if _, ok := metric.svcDsts[key]; ok {
+		return
+	}
+	m, err := metric.agent.flowMapOpener(metric.flowSvcMapName())
+	if err != nil {
+		return
+	}
+	defer m.Close()
+	var sd svcDst
+	if err = m.Lookup(keyOut, &sd); err == nil {
+		if metric.svcDsts == nil {
+			metric.svcDsts = make(map[interface{}]svcDst)
+		}
+		metric.svcDsts[key] = sd
+	}
+}
+
+// deleteSvcDsts removes the original destinations of flows that were
+// finalized or aged out, which the kernel would otherwise only evict once
+// the svc map is full. Destinations already evicted are skipped.
+func (metric *FlowMetricsEntry) deleteSvcDsts(keys []interface{}) {
+	if len(keys) == 0 || metric.agent.config.ServiceResolution == ServiceResolutionConntrack {
+		return
+	}
+	m, err := metric.agent.flowMapOpener(metric.flowSvcMapName())
+	if err != nil {
+		metric.agent.log.Debug("Not deleting service destinations: ", err)
+		return
+	}
+	defer m.Close()
+	for _, key := range keys {
+		delete(metric.svcDsts, key)
+		if err = m.Delete(key); err != nil {
+			metric.agent.log.Debug("Failed to delete from ", metric.flowSvcMapName(), ": ", err)
+		}
+	}
+}
+
+// applySvcDst attributes a flow of a pod to the service its socket
+// connected to, whether the flow is keyed with the service address or
+// with the backend it was translated to, and records the backend when it
+// is a pod. Other backend addresses are left out of the labels, they are
+// unbounded. A flow that reached the backend pod itself has no other
+// backend.
+func (metric *FlowMetricsEntry) applySvcDst(keyOut FlowKey, podStatsKey *PodStatsKey, keyType int) int {
+	sd, ok := metric.svcDsts[flowKeyValue(keyOut)]
+	if !ok || keyType&TO_POD_KEY == 0 {
+		return keyType
+	}
+	v4 := metric.selIndex == flowMapSelV4
+	svcIp := ipString(sd.Svc_ip, v4)
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	svcEp, ok := metric.agent.resolveSvc(svcIp, podStatsKey.Proto, strconv.Itoa(int(portValue(sd.Svc_port))))
+	if !ok {
+		return keyType
+	}
+	backendIp := keyOut.GetSrcIp()
+	if sd.Backend_ip != [4]uint32{} {
+		backendIp = ipString(sd.Backend_ip, v4)
+	}
+	if backendIp == keyOut.GetDstIp() {
+		setBackendSide(podStatsKey, keyType, svcEp, metric.agent.config.BackendClientLabels)
+		return FROM_SVC_KEY | TO_POD_KEY
+	}
+	podStatsKey.Endpoints[0] = svcEp
+	podStatsKey.Backend = ""
+	if backendName, ok := metric.agent.podIpToName[backendIp]; ok && backendIp != svcIp {
+		podStatsKey.Backend = backendName
+	}
+	return FROM_SVC_KEY | TO_POD_KEY
+}
+
+// setBackendSide attributes the flow of a local backend pod to the service
+// endpoint svcEp it was reached through. The client is kept when it is a
+// pod and keepClient is set, otherwise the flows of all clients are
+// aggregated.
+func setBackendSide(podStatsKey *PodStatsKey, keyType int, svcEp string, keepClient bool) {
+	podStatsKey.Client = ""
+	if keepClient && keyType&FROM_POD_KEY != 0 {
+		podStatsKey.Client = podStatsKey.Endpoints[0]
+	}
+	podStatsKey.Endpoints[0] = svcEp
+	podStatsKey.Backend = ""
+	podStatsKey.Side = SvcSideBackend
+}
+
+// applyBackendSvc attributes a flow to a local backend pod to the service
+// whose EndpointSlices list the pod address and port the flow reached.
+// Flows of clients already attributed to a service are left alone. How
+// the service was accessed is unknown on the backend side.
+func (metric *FlowMetricsEntry) applyBackendSvc(keyOut FlowKey, podStatsKey *PodStatsKey, keyType int) int {
+	if keyType&TO_POD_KEY == 0 || keyType&FROM_SVC_KEY != 0 {
+		return keyType
+	}
+	metric.agent.stateMutex.Lock()
+	defer metric.agent.stateMutex.Unlock()
+	svcName, ok := metric.agent.backendToSvc[backendKey(podStatsKey.Proto, keyOut.GetDstIp(), keyOut.GetDPort())]
+	if !ok {
+		return keyType
+	}
+	svcInfo, ok := metric.agent.svcInfo[svcName]
+	if !ok {
+		return keyType
+	}
+	setBackendSide(podStatsKey, keyType, svcEndpoint(svcName, svcInfo.SvcType, ""),
+		metric.agent.config.BackendClientLabels)
+	return FROM_SVC_KEY | TO_POD_KEY
+}
+
+// podStatsKey returns the endpoints of a flow, with the service it was
+// addressed to or the service whose backend it reached when known
+func (metric *FlowMetricsEntry) podStatsKey(keyOut FlowKey) (PodStatsKey, int) {
+	podStatsKey, keyType := getPodStatsKey(metric.agent, keyOut)
+	keyType = metric.applySvcDst(keyOut, &podStatsKey, keyType)
+	keyType = metric.applyBackendSvc(keyOut, &podStatsKey, keyType)
+	return podStatsKey, keyType
+}
@@ -35,3 +35,9 @@ func (flow *inet_v6_flow) GetSPort() string {
 func (flow *inet_v6_flow) GetDPort() string {
 	return flow.L4.GetDPort()
 }
+
+func NewInetV6FlowMetricsEntry(agent *StatsAgent) *FlowMetricsEntry {
+	return NewFlowMetricsEntry(agent, "v6_flow_map", "ipv6", flowMapSelV6, func() FlowKey {
+		return &inet_v6_flow{}
+	})
+}
@@ -3,6 +3,7 @@ package statsagent
 import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
 	"strings"
 	"sync"
 	"time"
@@ -18,16 +19,49 @@ type FlowKey interface {
 	GetDPort() string
 }
 
+// First_seen_ns and Last_seen_ns are bpf_ktime_get_ns timestamps, see
+// monotonicNow. Tcp_flags_out and Tcp_flags_in are the TCP flags seen in
+// each direction. Syn_count counts connection attempts, Syn_ack_count
+// established connections.
 type FlowStats struct {
-	Out_bytes   uint64
-	Out_packets uint64
-	In_bytes    uint64
-	In_packets  uint64
+	Out_bytes        uint64
+	Out_packets      uint64
+	In_bytes         uint64
+	In_packets       uint64
+	First_seen_ns    uint64
+	Last_seen_ns     uint64
+	Tcp_flags_out    uint32
+	Tcp_flags_in     uint32
+	Syn_count        uint64
+	Syn_ack_count    uint64
+	Fin_count        uint64
+	Rst_count        uint64
+	Out_frag_packets uint64
+	In_frag_packets  uint64
+}
+
+// Duration returns the time between the first and the last packet
+func (fs *FlowStats) Duration() time.Duration {
+	if fs.Last_seen_ns < fs.First_seen_ns {
+		return 0
+	}
+	return time.Duration(fs.Last_seen_ns - fs.First_seen_ns)
+}
+
+// monotonicNow returns the time on the clock used by bpf_ktime_get_ns
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return uint64(ts.Nano())
 }
 
 func (fs *FlowStats) swap() {
 	fs.Out_packets, fs.In_packets = fs.In_packets, fs.Out_packets
 	fs.Out_bytes, fs.In_bytes = fs.In_bytes, fs.Out_bytes
+	fs.Tcp_flags_out, fs.Tcp_flags_in = fs.Tcp_flags_in, fs.Tcp_flags_out
+	fs.Out_frag_packets, fs.In_frag_packets = fs.In_frag_packets, fs.Out_frag_packets
 }
 
 func addFlowStats(baseStats *FlowStats, incStats *FlowStats) {
@@ -35,30 +69,78 @@ func addFlowStats(baseStats *FlowStats, incStats *FlowStats) {
 	baseStats.Out_packets += incStats.Out_packets
 	baseStats.In_bytes += incStats.In_bytes
 	baseStats.In_packets += incStats.In_packets
+	baseStats.Tcp_flags_out |= incStats.Tcp_flags_out
+	baseStats.Tcp_flags_in |= incStats.Tcp_flags_in
+	baseStats.Syn_count += incStats.Syn_count
+	baseStats.Syn_ack_count += incStats.Syn_ack_count
+	baseStats.Fin_count += incStats.Fin_count
+	baseStats.Rst_count += incStats.Rst_count
+	baseStats.Out_frag_packets += incStats.Out_frag_packets
+	baseStats.In_frag_packets += incStats.In_frag_packets
+	if baseStats.First_seen_ns == 0 ||
+		(incStats.First_seen_ns != 0 && incStats.First_seen_ns < baseStats.First_seen_ns) {
+		baseStats.First_seen_ns = incStats.First_seen_ns
+	}
+	if incStats.Last_seen_ns > baseStats.Last_seen_ns {
+		baseStats.Last_seen_ns = incStats.Last_seen_ns
+	}
 }
 
 func diffFlowStats(oldStats *FlowStats, newStats *FlowStats) *FlowStats {
 	if (newStats.Out_bytes < oldStats.Out_bytes) ||
 		(newStats.Out_packets < oldStats.Out_packets) ||
 		(newStats.In_bytes < oldStats.In_bytes) ||
-		(newStats.In_packets < oldStats.In_packets) {
-		return &FlowStats{}
+		(newStats.In_packets < oldStats.In_packets) ||
+		(newStats.Syn_count < oldStats.Syn_count) ||
+		(newStats.Syn_ack_count < oldStats.Syn_ack_count) ||
+		(newStats.Fin_count < oldStats.Fin_count) ||
+		(newStats.Rst_count < oldStats.Rst_count) ||
+		(newStats.Out_frag_packets < oldStats.Out_frag_packets) ||
+		(newStats.In_frag_packets < oldStats.In_frag_packets) {
+		return &FlowStats{
+			First_seen_ns: newStats.First_seen_ns,
+			Last_seen_ns:  newStats.Last_seen_ns,
+			Tcp_flags_out: newStats.Tcp_flags_out,
+			Tcp_flags_in:  newStats.Tcp_flags_in,
+		}
 	}
 
 	return &FlowStats{
-		Out_bytes:   newStats.Out_bytes - oldStats.Out_bytes,
-		Out_packets: newStats.Out_packets - oldStats.Out_packets,
-		In_bytes:    newStats.In_bytes - oldStats.In_bytes,
-		In_packets:  newStats.In_packets - oldStats.In_packets,
+		Out_bytes:        newStats.Out_bytes - oldStats.Out_bytes,
+		Out_packets:      newStats.Out_packets - oldStats.Out_packets,
+		In_bytes:         newStats.In_bytes - oldStats.In_bytes,
+		In_packets:       newStats.In_packets - oldStats.In_packets,
+		Syn_count:        newStats.Syn_count - oldStats.Syn_count,
+		Syn_ack_count:    newStats.Syn_ack_count - oldStats.Syn_ack_count,
+		Fin_count:        newStats.Fin_count - oldStats.Fin_count,
+		Rst_count:        newStats.Rst_count - oldStats.Rst_count,
+		Out_frag_packets: newStats.Out_frag_packets - oldStats.Out_frag_packets,
+		In_frag_packets:  newStats.In_frag_packets - oldStats.In_frag_packets,
+		First_seen_ns:    newStats.First_seen_ns,
+		Last_seen_ns:     newStats.Last_seen_ns,
+		Tcp_flags_out:    newStats.Tcp_flags_out,
+		Tcp_flags_in:     newStats.Tcp_flags_in,
 	}
 }
 
+// Backend is the pod a service endpoint was translated to, when known, and
+// Proto the protocol name of the flows. Side is SvcSideBackend when the pod
+// is the backend the service endpoint reached, Client then names the
+// client pod when known and labelled, see setBackendSide.
 type PodStatsKey struct {
 	Endpoints [2]string
+	Backend   string `json:",omitempty"`
+	Proto     string `json:",omitempty"`
+	Side      string `json:",omitempty"`
+	Client    string `json:",omitempty"`
 }
 
+// clear leaves a single endpoint key, which has no backend or client
 func (psk *PodStatsKey) clear(ep int) {
 	psk.Endpoints[ep] = ""
+	psk.Backend = ""
+	psk.Side = ""
+	psk.Client = ""
 }
 
 func (psk *PodStatsKey) swap() {
@@ -66,12 +148,20 @@ func (psk *PodStatsKey) swap() {
 }
 
 type PromMetricsKey struct {
-	podNamespace [2]string
-	podName      [2]string
-	svcNamespace [2]string
-	svcScope     [2]string
-	svcName      [2]string
-	metricName   string
+	podNamespace     [2]string
+	podName          [2]string
+	svcNamespace     [2]string
+	svcScope         [2]string
+	svcName          [2]string
+	svcAccess        [2]string
+	backendNamespace string
+	backendName      string
+	svcSide          string
+	clientNamespace  string
+	clientName       string
+	protocol         string
+	ipFamily         string
+	metricName       string
 }
 
 const (
@@ -82,18 +172,40 @@ const (
 	TO_SVC_KEY
 )
 
-func (key *PodStatsKey) toPromMetricsKey(agent *StatsAgent) *PromMetricsKey {
+func (key *PodStatsKey) toPromMetricsKey(agent *StatsAgent, ipFamily string) *PromMetricsKey {
 	var promMetricsKey PromMetricsKey
 	var keyType int
+	promMetricsKey.ipFamily = ipFamily
+	promMetricsKey.protocol = key.Proto
+	if key.Proto == "" {
+		promMetricsKey.protocol = protoOther
+	}
+	// Older agents saved backends that are not pods by address
+	if backend := strings.SplitN(key.Backend, "/", 2); len(backend) == 2 {
+		promMetricsKey.backendNamespace = backend[0]
+		promMetricsKey.backendName = backend[1]
+	}
+	promMetricsKey.svcSide = SvcSideClient
+	if key.Side != "" {
+		promMetricsKey.svcSide = key.Side
+	}
+	if client := strings.SplitN(key.Client, "/", 2); len(client) == 2 {
+		promMetricsKey.clientNamespace = client[0]
+		promMetricsKey.clientName = client[1]
+	}
 	svcCount := 0
 	podCount := 0
 	for i := 0; i < 2; i++ {
-		splitStrings := strings.SplitN(key.Endpoints[i], "/", 3)
+		// Services saved by older agents have no access
+		splitStrings := strings.SplitN(key.Endpoints[i], "/", 4)
 		switch {
-		case len(splitStrings) == 3:
+		case len(splitStrings) >= 3:
 			promMetricsKey.svcNamespace[svcCount] = splitStrings[0]
 			promMetricsKey.svcName[svcCount] = splitStrings[1]
 			promMetricsKey.svcScope[svcCount] = splitStrings[2]
+			if len(splitStrings) == 4 {
+				promMetricsKey.svcAccess[svcCount] = splitStrings[3]
+			}
 			svcCount++
 			if i == 0 {
 				keyType |= FROM_SVC_KEY
@@ -134,6 +246,9 @@ func (key *PodStatsKey) toPromMetricsKey(agent *StatsAgent) *PromMetricsKey {
 func getPodStatsKey(agent *StatsAgent, keyOut FlowKey) (PodStatsKey, int) {
 	var podStatsKey PodStatsKey
 	var keyType int
+	if l4 := flowL4(keyOut); l4 != nil {
+		podStatsKey.Proto = protoName(l4.Ip_proto)
+	}
 	srcName, sok := agent.podIpToName[keyOut.GetSrcIp()]
 	dstName, dok := agent.podIpToName[keyOut.GetDstIp()]
 	if sok {
@@ -144,15 +259,13 @@ func getPodStatsKey(agent *StatsAgent, keyOut FlowKey) (PodStatsKey, int) {
 		podStatsKey.Endpoints[1] = dstName
 		keyType |= TO_POD_KEY
 	}
-	srcName, sok = agent.svcIpToName[keyOut.GetSrcIp()]
-	dstName, dok = agent.svcIpToName[keyOut.GetDstIp()]
+	srcName, sok = agent.resolveSvc(keyOut.GetSrcIp(), podStatsKey.Proto, keyOut.GetSPort())
+	dstName, dok = agent.resolveSvc(keyOut.GetDstIp(), podStatsKey.Proto, keyOut.GetDPort())
 	if sok {
-		srcName += "/" + agent.svcInfo[srcName].SvcType
 		podStatsKey.Endpoints[0] = srcName
 		keyType |= FROM_SVC_KEY
 	}
 	if dok {
-		dstName += "/" + agent.svcInfo[dstName].SvcType
 		podStatsKey.Endpoints[1] = dstName
 		keyType |= TO_SVC_KEY
 	}
@@ -166,18 +279,26 @@ func getPodStatsKey(agent *StatsAgent, keyOut FlowKey) (PodStatsKey, int) {
 	return podStatsKey, keyType
 }
 
+// TimeStamp is the time of the last scan that updated the entry
 type FlowStatsEntry struct {
-	Stats         FlowStats
-	Aging_counter uint8
-	TimeStamp     time.Time
+	Stats     FlowStats
+	TimeStamp time.Time
 }
 
 func (fs *FlowStatsEntry) add(stats *FlowStats, t *time.Time) {
 	addFlowStats(&fs.Stats, stats)
-	fs.Aging_counter = 0
 	fs.TimeStamp = *t
 }
 
+// idleFor returns how long the entry has not seen traffic at the scan at
+// t, falling back to the scan times when there is no kernel timestamp
+func (fs *FlowStatsEntry) idleFor(now uint64, t time.Time) time.Duration {
+	if fs.Stats.Last_seen_ns != 0 && fs.Stats.Last_seen_ns <= now {
+		return time.Duration(now - fs.Stats.Last_seen_ns)
+	}
+	return t.Sub(fs.TimeStamp)
+}
+
 func (fs *FlowStatsEntry) swap() {
 	fs.Stats.swap()
 }
@@ -189,16 +310,35 @@ type MetricsEntry interface {
 	UpdateStats()
 }
 
+// scanTrigger is implemented by MetricsEntries that can ask for a scan
+// before their interval expires
+type scanTrigger interface {
+	ScanTrigger() <-chan struct{}
+}
+
+// runMetric reads the interval again after every scan, so that entries can
+// adapt it
 func runMetric(m MetricsEntry, stopCh <-chan struct{}) {
+	var trigger <-chan struct{}
+	if t, ok := m.(scanTrigger); ok {
+		trigger = t.ScanTrigger()
+	}
 	go func() {
-		ticker := time.NewTicker(time.Duration(m.GetStatsInterval()) * time.Second)
+		timer := time.NewTimer(time.Duration(m.GetStatsInterval()) * time.Second)
 		for {
 			select {
 			case <-stopCh:
-				ticker.Stop()
-				break
-			case <-ticker.C:
+				timer.Stop()
+				return
+			case <-timer.C:
 				m.UpdateStats()
+				timer.Reset(time.Duration(m.GetStatsInterval()) * time.Second)
+			case <-trigger:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				m.UpdateStats()
+				timer.Reset(time.Duration(m.GetStatsInterval()) * time.Second)
 			}
 		}
 	}()
@@ -216,6 +356,7 @@ func (agent *StatsAgent) RunMetrics(stopCh <-chan struct{}) {
 	for _, m := range agent.metrics {
 		m.Run(stopCh)
 	}
+	agent.runFlowEvents(stopCh)
 }
 
 func (agent *StatsAgent) registerMetric(name string, entry MetricsEntry) {
@@ -226,7 +367,12 @@ func (agent *StatsAgent) registerMetric(name string, entry MetricsEntry) {
 
 func (agent *StatsAgent) registerMetrics() {
 	agent.registerMetric("v4PodStats", NewInetV4FlowMetricsEntry(agent))
-	//agent.registerMetric("v6PodStats", agent.getNewV6PodMetricEntry())
+	agent.registerMetric("v6PodStats", NewInetV6FlowMetricsEntry(agent))
+	if agent.bpfLoader != nil && !agent.bpfLoader.Attached(sockOpsPinName) {
+		agent.log.Warn("No ", sockOpsPinName, " program, not exporting RTT metrics")
+		return
+	}
+	agent.registerMetric("tcpRtt", NewRttMetricsEntry(agent))
 }
 
 func (agent *StatsAgent) registerPrometheusSubsystem(entry PromSubsystemEntry) {
@@ -242,6 +388,16 @@ func (agent *StatsAgent) registerPrometheusMetrics() {
 	agent.registerPrometheusSubsystem(entry)
 	entry = NewPodPromSubsystemEntry()
 	agent.registerPrometheusSubsystem(entry)
+	entry = NewAgentPromSubsystemEntry()
+	agent.registerPrometheusSubsystem(entry)
+	entry = NewPodConnPromSubsystemEntry()
+	agent.registerPrometheusSubsystem(entry)
+	entry = NewSvcConnPromSubsystemEntry()
+	agent.registerPrometheusSubsystem(entry)
+	entry = NewPodSvcTcpPromSubsystemEntry()
+	agent.registerPrometheusSubsystem(entry)
+	entry = NewPodIcmpPromSubsystemEntry()
+	agent.registerPrometheusSubsystem(entry)
 }
 
 //Prometheus wrappers
@@ -251,13 +407,29 @@ type PromGauge struct {
 	Cache      *prometheus.GaugeVec
 }
 
+type PromHistogram struct {
+	Name  string
+	Cache *prometheus.HistogramVec
+}
+
 type PromSubsystem struct {
-	Subsystem string
-	Gauges    map[string]*PromGauge
+	Subsystem  string
+	Gauges     map[string]*PromGauge
+	Histograms map[string]*PromHistogram
+}
+
+// GetHistogramVec returns the named histogram of subsystems that have
+// histograms, or nil
+func (subsystem *PromSubsystem) GetHistogramVec(metricName string) *prometheus.HistogramVec {
+	if histogram, ok := subsystem.Histograms[metricName]; ok {
+		return histogram.Cache
+	}
+	return nil
 }
 
 type PromSubsystemEntry interface {
 	SubsystemName() string
 	RegisterPrometheus(agent *StatsAgent)
 	GetGaugeVec(string) *prometheus.GaugeVec
+	GetHistogramVec(string) *prometheus.HistogramVec
 }
@@ -0,0 +1,101 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The addresses of all nodes are indexed, so that traffic to the node port
+// of a service on any node is attributed to the service
+
+func (agent *StatsAgent) initNodeInformerFromClient(
+	kubeClient *kubernetes.Clientset) {
+	agent.initNodeInformerBase(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return kubeClient.CoreV1().Nodes().List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return kubeClient.CoreV1().Nodes().Watch(context.TODO(), options)
+			},
+		})
+}
+
+func (agent *StatsAgent) initNodeInformerBase(listWatch *cache.ListWatch) {
+	agent.nodeInformer = cache.NewSharedIndexInformer(
+		listWatch,
+		&v1.Node{},
+		noResyncPeriod,
+		cache.Indexers{},
+	)
+	agent.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			agent.nodeUpdated(obj)
+		},
+		UpdateFunc: func(_ interface{}, obj interface{}) {
+			agent.nodeUpdated(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			agent.nodeDeleted(obj)
+		},
+	})
+}
+
+// nodeIPs returns the internal and external addresses of a node
+func nodeIPs(node *v1.Node) []string {
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP || addr.Type == v1.NodeExternalIP {
+			ips = append(ips, addr.Address)
+		}
+	}
+	return ips
+}
+
+func (agent *StatsAgent) nodeUpdated(obj interface{}) {
+	node := obj.(*v1.Node)
+	ips := nodeIPs(node)
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	removeIPs(agent.nodeIpToName, node.ObjectMeta.Name, agent.nodeInfo[node.ObjectMeta.Name], ips)
+	agent.nodeInfo[node.ObjectMeta.Name] = ips
+	for _, ip := range ips {
+		agent.nodeIpToName[ip] = node.ObjectMeta.Name
+	}
+	agent.log.Debug("Added node ", node.ObjectMeta.Name)
+}
+
+func (agent *StatsAgent) nodeDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	agent.stateMutex.Lock()
+	defer agent.stateMutex.Unlock()
+	removeIPs(agent.nodeIpToName, node.ObjectMeta.Name, agent.nodeInfo[node.ObjectMeta.Name], nil)
+	delete(agent.nodeInfo, node.ObjectMeta.Name)
+	agent.log.Debug("Deleted node ", node.ObjectMeta.Name)
+}
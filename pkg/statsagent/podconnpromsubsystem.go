@@ -0,0 +1,297 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+// Buckets of the connection and flow duration histograms, from 1ms to
+// about 70 minutes
+var connDurationBuckets = prometheus.ExponentialBuckets(0.001, 4, 12)
+
+const (
+	ConnDurationHistogram = "connection_duration_seconds"
+	ConnDurationHelp      = "duration of the TCP connections that were closed or reset"
+	FlowDurationHistogram = "flow_duration_seconds"
+	FlowDurationHelp      = "time between the first and the last packet of the flows that ended or aged out"
+)
+
+// PodConnStats Prometheus Entries, built from the flow events and the TCP
+// flag counters. The pod and service subsystems share the counters.
+var PodConnPromMetrics = [...]string{
+	"new_connections_per_second",
+	"connection_attempts",
+	"connections_established",
+	"connection_fins",
+	"connection_resets",
+}
+
+var PodConnPromHelp = [...]string{
+	"flows opened to or from the pod per second since the last scan",
+	"TCP SYNs without ACK seen on the connections",
+	"TCP SYN-ACKs seen on the connections",
+	"TCP FINs seen on the connections",
+	"TCP RSTs seen on the connections",
+}
+
+var SvcConnPromMetrics = [...]string{
+	"connection_attempts",
+	"connections_established",
+	"connection_fins",
+	"connection_resets",
+}
+
+var SvcConnPromHelp = [...]string{
+	"TCP SYNs without ACK seen on the connections",
+	"TCP SYN-ACKs seen on the connections",
+	"TCP FINs seen on the connections",
+	"TCP RSTs seen on the connections",
+}
+
+type PodConnPromSubsystemEntry struct {
+	*PromSubsystem
+}
+
+func podConnLabels(podKey string, ipFamily string) prometheus.Labels {
+	splitStrings := strings.SplitN(podKey, "/", 2)
+	labels := prometheus.Labels{
+		"pod_namespace": splitStrings[0],
+		"pod_name":      "",
+		"ip_family":     ipFamily,
+	}
+	if len(splitStrings) == 2 {
+		labels["pod_name"] = splitStrings[1]
+	}
+	return labels
+}
+
+func (agent *StatsAgent) SetPodConnGauge(podKey string, ipFamily string, rate float64) {
+	agent.promSubsystems["pod_conn_stats"].GetGaugeVec("new_connections_per_second").
+		With(podConnLabels(podKey, ipFamily)).Set(rate)
+}
+
+func (agent *StatsAgent) DeletePodConnGauge(podKey string, ipFamily string) {
+	agent.promSubsystems["pod_conn_stats"].GetGaugeVec("new_connections_per_second").
+		Delete(podConnLabels(podKey, ipFamily))
+}
+
+// SetConnGauges exports the TCP flag counters of the pod or service of key,
+// only its TCP stats have any
+func (agent *StatsAgent) SetConnGauges(key *PromMetricsKey, stats *FlowStats) {
+	if key.protocol != protoTcp {
+		return
+	}
+	subsystem, labels := durationLabels(key)
+	if labels == nil {
+		return
+	}
+	value := map[string]uint64{
+		"connection_attempts":     stats.Syn_count,
+		"connections_established": stats.Syn_ack_count,
+		"connection_fins":         stats.Fin_count,
+		"connection_resets":       stats.Rst_count,
+	}
+	for _, metricName := range SvcConnPromMetrics {
+		agent.promSubsystems[subsystem].GetGaugeVec(metricName).With(labels).Set(float64(value[metricName]))
+	}
+}
+
+// DeleteConnGauges deletes the TCP flag counters of a pod or service whose
+// TCP stats aged out
+func (agent *StatsAgent) DeleteConnGauges(key *PromMetricsKey) {
+	if key.protocol != protoTcp {
+		return
+	}
+	subsystem, labels := durationLabels(key)
+	if labels == nil {
+		return
+	}
+	for _, metricName := range SvcConnPromMetrics {
+		agent.promSubsystems[subsystem].GetGaugeVec(metricName).Delete(labels)
+	}
+}
+
+// durationLabels returns the subsystem and labels of the TCP flag counters
+// and the duration histograms of the pod or service of key
+func durationLabels(key *PromMetricsKey) (string, prometheus.Labels) {
+	switch key.metricName {
+	case "pod_stats":
+		return "pod_conn_stats", prometheus.Labels{
+			"pod_namespace": key.podNamespace[0],
+			"pod_name":      key.podName[0],
+			"ip_family":     key.ipFamily}
+	case "svc_stats":
+		return "svc_conn_stats", prometheus.Labels{
+			"svc_namespace": key.svcNamespace[0],
+			"svc_scope":     key.svcScope[0],
+			"svc_name":      key.svcName[0],
+			"svc_access":    key.svcAccess[0],
+			"ip_family":     key.ipFamily}
+	}
+	return "", nil
+}
+
+// ObserveConnDuration records the duration of a connection of the pod or
+// service of key
+func (agent *StatsAgent) ObserveConnDuration(key *PromMetricsKey, duration time.Duration) {
+	subsystem, labels := durationLabels(key)
+	if labels == nil {
+		return
+	}
+	agent.promSubsystems[subsystem].GetHistogramVec(ConnDurationHistogram).With(labels).Observe(duration.Seconds())
+}
+
+// ObserveFlowDuration records the duration of a flow of the pod or service
+// of key, of any protocol
+func (agent *StatsAgent) ObserveFlowDuration(key *PromMetricsKey, duration time.Duration) {
+	subsystem, labels := durationLabels(key)
+	if labels == nil {
+		return
+	}
+	labels["protocol"] = key.protocol
+	agent.promSubsystems[subsystem].GetHistogramVec(FlowDurationHistogram).With(labels).Observe(duration.Seconds())
+}
+
+// registerDurations registers the connection and flow duration histograms
+// of a subsystem, flows are labelled by protocol as well
+func registerDurations(agent *StatsAgent, subsystem *PromSubsystem, labels []string) {
+	registerDuration(agent, subsystem, ConnDurationHistogram, ConnDurationHelp, labels)
+	flowLabels := append(append([]string{}, labels...), "protocol")
+	registerDuration(agent, subsystem, FlowDurationHistogram, FlowDurationHelp, flowLabels)
+}
+
+func registerDuration(agent *StatsAgent, subsystem *PromSubsystem, name string, help string, labels []string) {
+	histogram :=
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "statsagent",
+			Subsystem: subsystem.Subsystem,
+			Name:      name,
+			Help:      help,
+			Buckets:   connDurationBuckets,
+		}, labels)
+	subsystem.Histograms[name] = &PromHistogram{
+		Name:  name,
+		Cache: histogram,
+	}
+	err := prometheus.Register(histogram)
+	if err != nil {
+		agent.log.Error("Failed to register ", name, " with Prometheus: ", err)
+	} else {
+		agent.log.Debug("Registered ", name, " with Prometheus: ")
+	}
+}
+
+func (entry *PodConnPromSubsystemEntry) SubsystemName() string {
+	return entry.Subsystem
+}
+
+func (entry *PodConnPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
+	for i, metricName := range PodConnPromMetrics {
+		gauge :=
+			prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "statsagent",
+				Subsystem: "pod_conn_stats",
+				Name:      metricName,
+				Help:      PodConnPromHelp[i],
+			}, []string{
+				"pod_namespace", "pod_name", "ip_family",
+			})
+		entry.Gauges[metricName] = &PromGauge{
+			Name:  metricName,
+			Cache: gauge,
+		}
+		err := prometheus.Register(gauge)
+		if err != nil {
+			agent.log.Error("Failed to register ", metricName, " with Prometheus: ", err)
+		} else {
+			agent.log.Debug("Registered ", metricName, " with Prometheus: ")
+		}
+	}
+	registerDurations(agent, entry.PromSubsystem, []string{
+		"pod_namespace", "pod_name", "ip_family",
+	})
+}
+
+func (entry *PodConnPromSubsystemEntry) GetGaugeVec(metricName string) *prometheus.GaugeVec {
+	return entry.Gauges[metricName].Cache
+}
+
+func NewPodConnPromSubsystemEntry() PromSubsystemEntry {
+	promSubsystem := &PromSubsystem{
+		Subsystem:  "pod_conn_stats",
+		Gauges:     make(map[string]*PromGauge),
+		Histograms: make(map[string]*PromHistogram),
+	}
+
+	return &PodConnPromSubsystemEntry{
+		PromSubsystem: promSubsystem,
+	}
+}
+
+// SvcConnStats Prometheus Entries, the TCP flag counters and the
+// histograms of the service connections
+type SvcConnPromSubsystemEntry struct {
+	*PromSubsystem
+}
+
+func (entry *SvcConnPromSubsystemEntry) SubsystemName() string {
+	return entry.Subsystem
+}
+
+func (entry *SvcConnPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
+	for i, metricName := range SvcConnPromMetrics {
+		gauge :=
+			prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "statsagent",
+				Subsystem: "svc_conn_stats",
+				Name:      metricName,
+				Help:      SvcConnPromHelp[i],
+			}, []string{
+				"svc_namespace", "svc_name", "svc_scope", "svc_access", "ip_family",
+			})
+		entry.Gauges[metricName] = &PromGauge{
+			Name:  metricName,
+			Cache: gauge,
+		}
+		err := prometheus.Register(gauge)
+		if err != nil {
+			agent.log.Error("Failed to register ", metricName, " with Prometheus: ", err)
+		} else {
+			agent.log.Debug("Registered ", metricName, " with Prometheus: ")
+		}
+	}
+	registerDurations(agent, entry.PromSubsystem, []string{
+		"svc_namespace", "svc_name", "svc_scope", "svc_access", "ip_family",
+	})
+}
+
+func (entry *SvcConnPromSubsystemEntry) GetGaugeVec(metricName string) *prometheus.GaugeVec {
+	return entry.Gauges[metricName].Cache
+}
+
+func NewSvcConnPromSubsystemEntry() PromSubsystemEntry {
+	promSubsystem := &PromSubsystem{
+		Subsystem:  "svc_conn_stats",
+		Gauges:     make(map[string]*PromGauge),
+		Histograms: make(map[string]*PromHistogram),
+	}
+
+	return &SvcConnPromSubsystemEntry{
+		PromSubsystem: promSubsystem,
+	}
+}
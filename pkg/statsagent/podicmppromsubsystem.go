@@ -0,0 +1,115 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+// PodIcmpStats Prometheus Entries, in the order of the ICMP counters
+var PodIcmpPromMetrics = [...]string{
+	"echo_requests",
+	"destination_unreachables",
+	"fragmentation_needed",
+	"time_exceeded",
+}
+
+var PodIcmpPromHelp = [...]string{
+	"ICMP and ICMPv6 echo requests",
+	"ICMP and ICMPv6 destination unreachable messages, other than fragmentation needed",
+	"ICMP fragmentation needed and ICMPv6 packet too big messages",
+	"ICMP and ICMPv6 time exceeded messages",
+}
+
+type PodIcmpPromSubsystemEntry struct {
+	*PromSubsystem
+}
+
+func podIcmpLabels(podKey string, ipFamily string, direction string) prometheus.Labels {
+	splitStrings := strings.SplitN(podKey, "/", 2)
+	labels := prometheus.Labels{
+		"pod_namespace": splitStrings[0],
+		"pod_name":      "",
+		"ip_family":     ipFamily,
+		"direction":     direction,
+	}
+	if len(splitStrings) == 2 {
+		labels["pod_name"] = splitStrings[1]
+	}
+	return labels
+}
+
+// SetPodIcmpGauges exports the ICMP counters of a pod, received by the pod
+// in rx and sent in tx
+func (agent *StatsAgent) SetPodIcmpGauges(podKey string, ipFamily string, counts *icmpCounts) {
+	for i, metricName := range PodIcmpPromMetrics {
+		gauge := agent.promSubsystems["pod_icmp_stats"].GetGaugeVec(metricName)
+		gauge.With(podIcmpLabels(podKey, ipFamily, "rx")).Set(float64(counts[i][0]))
+		gauge.With(podIcmpLabels(podKey, ipFamily, "tx")).Set(float64(counts[i][1]))
+	}
+}
+
+func (agent *StatsAgent) DeletePodIcmpGauges(podKey string, ipFamily string) {
+	for _, metricName := range PodIcmpPromMetrics {
+		gauge := agent.promSubsystems["pod_icmp_stats"].GetGaugeVec(metricName)
+		gauge.Delete(podIcmpLabels(podKey, ipFamily, "rx"))
+		gauge.Delete(podIcmpLabels(podKey, ipFamily, "tx"))
+	}
+}
+
+func (entry *PodIcmpPromSubsystemEntry) SubsystemName() string {
+	return entry.Subsystem
+}
+
+func (entry *PodIcmpPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
+	for i, metricName := range PodIcmpPromMetrics {
+		gauge :=
+			prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "statsagent",
+				Subsystem: "pod_icmp_stats",
+				Name:      metricName,
+				Help:      PodIcmpPromHelp[i],
+			}, []string{
+				"pod_namespace", "pod_name", "ip_family", "direction",
+			})
+		entry.Gauges[metricName] = &PromGauge{
+			Name:  metricName,
+			Cache: gauge,
+		}
+		err := prometheus.Register(gauge)
+		if err != nil {
+			agent.log.Error("Failed to register ", metricName, " with Prometheus: ", err)
+		} else {
+			agent.log.Debug("Registered ", metricName, " with Prometheus: ")
+		}
+	}
+}
+
+func (entry *PodIcmpPromSubsystemEntry) GetGaugeVec(metricName string) *prometheus.GaugeVec {
+	return entry.Gauges[metricName].Cache
+}
+
+func NewPodIcmpPromSubsystemEntry() PromSubsystemEntry {
+	promSubsystem := &PromSubsystem{
+		Subsystem:  "pod_icmp_stats",
+		Gauges:     make(map[string]*PromGauge),
+		Histograms: make(map[string]*PromHistogram),
+	}
+
+	return &PodIcmpPromSubsystemEntry{
+		PromSubsystem: promSubsystem,
+	}
+}
@@ -25,8 +25,6 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-
-	"k8s.io/kubernetes/pkg/controller"
 )
 
 func (agent *StatsAgent) initPodInformerFromClient(
@@ -52,7 +50,7 @@ func (agent *StatsAgent) initPodInformerBase(listWatch *cache.ListWatch) {
 	agent.podInformer = cache.NewSharedIndexInformer(
 		listWatch,
 		&v1.Pod{},
-		controller.NoResyncPeriodFunc(),
+		noResyncPeriod,
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 	)
 	agent.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -68,30 +66,59 @@ func (agent *StatsAgent) initPodInformerBase(listWatch *cache.ListWatch) {
 	})
 }
 
+// podIPs returns the addresses of a pod, PodIPs being empty on older
+// clusters
+func podIPs(pod *v1.Pod) []string {
+	var ips []string
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" {
+			ips = append(ips, podIP.IP)
+		}
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
 func (agent *StatsAgent) podUpdated(obj interface{}) {
 	pod := obj.(*v1.Pod)
 	podKey := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	var podInfo PodInfo
-	if pod.Status.PodIP == "" || pod.Spec.HostNetwork {
-		return
+	podInfo.PodIPs = podIPs(pod)
+	if pod.Spec.HostNetwork {
+		podInfo.PodIPs = nil
 	}
-	podInfo.PodIP = pod.Status.PodIP
 	agent.stateMutex.Lock()
 	defer agent.stateMutex.Unlock()
+	// A pod that lost its addresses no longer owns those it had
+	removeIPs(agent.podIpToName, podKey, agent.podInfo[podKey].PodIPs, podInfo.PodIPs)
+	if len(podInfo.PodIPs) == 0 {
+		delete(agent.podInfo, podKey)
+		return
+	}
 	agent.podInfo[podKey] = podInfo
-	agent.podIpToName[pod.Status.PodIP] = podKey
+	for _, podIP := range podInfo.PodIPs {
+		agent.podIpToName[podIP] = podKey
+	}
+	agent.podUidToName[string(pod.ObjectMeta.UID)] = podKey
 	agent.log.Debug("Added pod ", podKey)
 }
 
 func (agent *StatsAgent) podDeleted(obj interface{}) {
 	pod := obj.(*v1.Pod)
-	if pod.Status.PodIP == "" || pod.Spec.HostNetwork {
+	if pod.Spec.HostNetwork {
 		return
 	}
 	podKey := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	agent.stateMutex.Lock()
 	defer agent.stateMutex.Unlock()
+	podInfo, ok := agent.podInfo[podKey]
+	if !ok {
+		return
+	}
+	removeIPs(agent.podIpToName, podKey, podInfo.PodIPs, nil)
 	delete(agent.podInfo, podKey)
-	delete(agent.podIpToName, pod.Status.PodIP)
+	delete(agent.podUidToName, string(pod.ObjectMeta.UID))
 	agent.log.Debug("Deleted pod ", podKey)
 }
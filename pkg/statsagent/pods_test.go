@@ -0,0 +1,139 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func testPod(name string, ips ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+	}
+	if len(ips) != 0 {
+		pod.Status.PodIP = ips[0]
+	}
+	return pod
+}
+
+func TestRemoveIPs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		oldIPs []string
+		newIPs []string
+		want   map[string]string
+	}{
+		{"kept", []string{"10.0.0.5", "fd00::5"}, []string{"10.0.0.5", "fd00::5"},
+			map[string]string{"10.0.0.5": "default/a", "fd00::5": "default/a", "10.0.0.6": "default/b"}},
+		{"one family removed", []string{"10.0.0.5", "fd00::5"}, []string{"10.0.0.5"},
+			map[string]string{"10.0.0.5": "default/a", "10.0.0.6": "default/b"}},
+		{"all removed", []string{"10.0.0.5", "fd00::5"}, nil,
+			map[string]string{"10.0.0.6": "default/b"}},
+		// An address another object took is left to it
+		{"moved", []string{"10.0.0.5", "fd00::5", "10.0.0.6"}, []string{"10.0.0.5", "fd00::5"},
+			map[string]string{"10.0.0.5": "default/a", "fd00::5": "default/a", "10.0.0.6": "default/b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ipToName := map[string]string{"10.0.0.5": "default/a", "fd00::5": "default/a", "10.0.0.6": "default/b"}
+			removeIPs(ipToName, "default/a", tc.oldIPs, tc.newIPs)
+			if !reflect.DeepEqual(ipToName, tc.want) {
+				t.Errorf("addresses %v, want %v", ipToName, tc.want)
+			}
+		})
+	}
+}
+
+// testPodOwners returns the pods indexed at the addresses of the pod
+// tests, "" if none is
+func testPodOwners(agent *StatsAgent) map[string]string {
+	owners := make(map[string]string)
+	for _, ip := range []string{"10.0.0.5", "fd00::5", "192.168.0.10"} {
+		owners[ip] = agent.podIpToName[ip]
+	}
+	return owners
+}
+
+func TestPodUpdated(t *testing.T) {
+	legacy := testPod("a")
+	legacy.Status.PodIP = "10.0.0.5"
+	for _, tc := range []struct {
+		name     string
+		updates  []*v1.Pod
+		wantA    string
+		wantB    string
+		wantPods []string
+	}{
+		{"dual-stack", []*v1.Pod{testPod("a", "10.0.0.5", "fd00::5")},
+			"default/a", "default/a", []string{"default/a"}},
+		{"without podIPs", []*v1.Pod{legacy}, "default/a", "", []string{"default/a"}},
+		{"family lost", []*v1.Pod{testPod("a", "10.0.0.5", "fd00::5"), testPod("a", "10.0.0.5")},
+			"default/a", "", []string{"default/a"}},
+		{"addresses lost", []*v1.Pod{testPod("a", "10.0.0.5", "fd00::5"), testPod("a")},
+			"", "", nil},
+		// The completed pod a reports no address after its address
+		// was given to b
+		{"address moved", []*v1.Pod{testPod("a", "10.0.0.5", "fd00::5"), testPod("b", "10.0.0.5"), testPod("a")},
+			"default/b", "", []string{"default/b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, _ := newTestAgent()
+			for _, pod := range tc.updates {
+				agent.podUpdated(pod)
+			}
+			want := map[string]string{"10.0.0.5": tc.wantA, "fd00::5": tc.wantB, "192.168.0.10": ""}
+			if owners := testPodOwners(agent); !reflect.DeepEqual(owners, want) {
+				t.Errorf("addresses %v, want %v", owners, want)
+			}
+			for _, podKey := range []string{"default/a", "default/b"} {
+				_, ok := agent.podInfo[podKey]
+				wantOk := false
+				for _, wantPod := range tc.wantPods {
+					wantOk = wantOk || wantPod == podKey
+				}
+				if ok != wantOk {
+					t.Errorf("pod %s indexed %v, want %v", podKey, ok, wantOk)
+				}
+			}
+		})
+	}
+}
+
+func TestPodUpdatedHostNetwork(t *testing.T) {
+	agent, _ := newTestAgent()
+	hostNetwork := testPod("a", "192.168.0.10")
+	hostNetwork.Spec.HostNetwork = true
+	agent.podUpdated(hostNetwork)
+	if _, ok := agent.podInfo["default/a"]; ok {
+		t.Error("host network pod indexed")
+	}
+	if podKey, ok := agent.podIpToName["192.168.0.10"]; ok {
+		t.Errorf("node address indexed to %s", podKey)
+	}
+}
+
+func TestPodDeletedKeepsMovedAddress(t *testing.T) {
+	agent, _ := newTestAgent()
+	agent.podUpdated(testPod("a", "10.0.0.5", "fd00::5"))
+	agent.podUpdated(testPod("b", "10.0.0.5"))
+	agent.podDeleted(testPod("a", "10.0.0.5", "fd00::5"))
+	want := map[string]string{"10.0.0.5": "default/b", "fd00::5": "", "192.168.0.10": ""}
+	if owners := testPodOwners(agent); !reflect.DeepEqual(owners, want) {
+		t.Errorf("addresses %v, want %v", owners, want)
+	}
+}
@@ -38,15 +38,38 @@ func (agent *StatsAgent) SetPodSvcGauge(
 		return
 	}
 	for i := 0; i < 4; i++ {
-		agent.promSubsystems["pod_svc_stats"].GetGaugeVec(PodSvcPromMetrics[i]).With(prometheus.Labels{
-			"pod_namespace": key.podNamespace[0],
-			"pod_name":      key.podName[0],
-			"svc_namespace": key.svcNamespace[0],
-			"svc_scope":     key.svcScope[0],
-			"svc_name":      key.svcName[0]}).Set(float64(value[i]))
+		agent.promSubsystems["pod_svc_stats"].GetGaugeVec(PodSvcPromMetrics[i]).With(podSvcLabels(key)).Set(float64(value[i]))
 	}
 }
 
+// DeletePodSvcGauge deletes the series of a pod and service pair that aged
+// out
+func (agent *StatsAgent) DeletePodSvcGauge(key *PromMetricsKey) {
+	if key.metricName != "pod_svc_stats" && key.metricName != "svc_pod_stats" {
+		return
+	}
+	for _, metricName := range PodSvcPromMetrics {
+		agent.promSubsystems["pod_svc_stats"].GetGaugeVec(metricName).Delete(podSvcLabels(key))
+	}
+}
+
+func podSvcLabels(key *PromMetricsKey) prometheus.Labels {
+	return prometheus.Labels{
+		"pod_namespace":     key.podNamespace[0],
+		"pod_name":          key.podName[0],
+		"svc_namespace":     key.svcNamespace[0],
+		"svc_scope":         key.svcScope[0],
+		"svc_name":          key.svcName[0],
+		"svc_access":        key.svcAccess[0],
+		"backend_namespace": key.backendNamespace,
+		"backend_name":      key.backendName,
+		"svc_side":          key.svcSide,
+		"client_namespace":  key.clientNamespace,
+		"client_name":       key.clientName,
+		"protocol":          key.protocol,
+		"ip_family":         key.ipFamily}
+}
+
 func (entry *PodSvcPromSubsystemEntry) SubsystemName() string {
 	return entry.Subsystem
 }
@@ -60,7 +83,9 @@ func (entry *PodSvcPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
 				Name:      metricName,
 				Help:      PodSvcPromHelp[i],
 			}, []string{
-				"pod_namespace", "pod_name", "svc_namespace", "svc_name", "svc_scope",
+				"pod_namespace", "pod_name", "svc_namespace", "svc_name", "svc_scope", "svc_access",
+				"backend_namespace", "backend_name", "svc_side", "client_namespace", "client_name",
+				"protocol", "ip_family",
 			})
 		entry.Gauges[metricName] = &PromGauge{
 			Name:  metricName,
@@ -121,13 +146,30 @@ func (agent *StatsAgent) SetSvcGauge(
 		return
 	}
 	for i := 0; i < 4; i++ {
-		agent.promSubsystems["svc_stats"].GetGaugeVec(SvcPromMetrics[i]).With(prometheus.Labels{
-			"svc_namespace": key.svcNamespace[0],
-			"svc_scope":     key.svcScope[0],
-			"svc_name":      key.svcName[0]}).Set(float64(value[i]))
+		agent.promSubsystems["svc_stats"].GetGaugeVec(SvcPromMetrics[i]).With(svcLabels(key)).Set(float64(value[i]))
+	}
+}
+
+// DeleteSvcGauge deletes the series of a service that aged out
+func (agent *StatsAgent) DeleteSvcGauge(key *PromMetricsKey) {
+	if key.metricName != "svc_stats" {
+		return
+	}
+	for _, metricName := range SvcPromMetrics {
+		agent.promSubsystems["svc_stats"].GetGaugeVec(metricName).Delete(svcLabels(key))
 	}
 }
 
+func svcLabels(key *PromMetricsKey) prometheus.Labels {
+	return prometheus.Labels{
+		"svc_namespace": key.svcNamespace[0],
+		"svc_scope":     key.svcScope[0],
+		"svc_name":      key.svcName[0],
+		"svc_access":    key.svcAccess[0],
+		"protocol":      key.protocol,
+		"ip_family":     key.ipFamily}
+}
+
 func (entry *SvcPromSubsystemEntry) SubsystemName() string {
 	return entry.Subsystem
 }
@@ -141,7 +183,7 @@ func (entry *SvcPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
 				Name:      metricName,
 				Help:      SvcPromHelp[i],
 			}, []string{
-				"svc_namespace", "svc_name", "svc_scope",
+				"svc_namespace", "svc_name", "svc_scope", "svc_access", "protocol", "ip_family",
 			})
 		entry.Gauges[metricName] = &PromGauge{
 			Name:  metricName,
@@ -177,6 +219,8 @@ var PodPromMetrics = [...]string{
 	"pod_tx_packets",
 	"pod_rx_bytes",
 	"pod_rx_packets",
+	"pod_tx_fragments",
+	"pod_rx_fragments",
 }
 
 var PodPromHelp = [...]string{
@@ -184,6 +228,8 @@ var PodPromHelp = [...]string{
 	"pod egress packets",
 	"pod ingress bytes",
 	"pod ingress packets",
+	"pod egress IP fragments",
+	"pod ingress IP fragments",
 }
 
 type PodPromSubsystemEntry struct {
@@ -193,19 +239,37 @@ type PodPromSubsystemEntry struct {
 func (agent *StatsAgent) SetPodGauge(
 	key *PromMetricsKey,
 	stats *FlowStats) {
-	var value [4]uint64
+	var value [6]uint64
 	value[0] = stats.Out_bytes
 	value[1] = stats.Out_packets
 	value[2] = stats.In_bytes
 	value[3] = stats.In_packets
+	value[4] = stats.Out_frag_packets
+	value[5] = stats.In_frag_packets
 	if key.metricName != "pod_stats" {
 		return
 	}
-	for i := 0; i < 4; i++ {
-		agent.promSubsystems["pod_stats"].GetGaugeVec(PodPromMetrics[i]).With(prometheus.Labels{
-			"pod_namespace": key.podNamespace[0],
-			"pod_name":      key.podName[0]}).Set(float64(value[i]))
+	for i := 0; i < 6; i++ {
+		agent.promSubsystems["pod_stats"].GetGaugeVec(PodPromMetrics[i]).With(podLabels(key)).Set(float64(value[i]))
+	}
+}
+
+// DeletePodGauge deletes the series of a pod that aged out
+func (agent *StatsAgent) DeletePodGauge(key *PromMetricsKey) {
+	if key.metricName != "pod_stats" {
+		return
 	}
+	for _, metricName := range PodPromMetrics {
+		agent.promSubsystems["pod_stats"].GetGaugeVec(metricName).Delete(podLabels(key))
+	}
+}
+
+func podLabels(key *PromMetricsKey) prometheus.Labels {
+	return prometheus.Labels{
+		"pod_namespace": key.podNamespace[0],
+		"pod_name":      key.podName[0],
+		"protocol":      key.protocol,
+		"ip_family":     key.ipFamily}
 }
 
 func (entry *PodPromSubsystemEntry) SubsystemName() string {
@@ -221,7 +285,7 @@ func (entry *PodPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
 				Name:      metricName,
 				Help:      PodPromHelp[i],
 			}, []string{
-				"pod_namespace", "pod_name",
+				"pod_namespace", "pod_name", "protocol", "ip_family",
 			})
 		entry.Gauges[metricName] = &PromGauge{
 			Name:  metricName,
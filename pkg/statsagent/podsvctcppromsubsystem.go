@@ -0,0 +1,139 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// PodSvcTcpStats Prometheus Entries, built from the sockops program
+var PodSvcTcpPromMetrics = [...]string{
+	"retransmits",
+}
+
+var PodSvcTcpPromHelp = [...]string{
+	"TCP segments retransmitted by the pod to the service",
+}
+
+const (
+	RttHistogram = "rtt_seconds"
+	RttHelp      = "smoothed RTT of the TCP connections of the pod to the service, sampled at every scan"
+)
+
+// Buckets of the RTT histogram, from 100us to about 3 seconds
+var rttBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16)
+
+var podSvcTcpPromLabels = []string{
+	"pod_namespace", "pod_name", "svc_namespace", "svc_name", "svc_scope", "svc_access", "ip_family",
+}
+
+type PodSvcTcpPromSubsystemEntry struct {
+	*PromSubsystem
+}
+
+func podSvcTcpLabels(key *PromMetricsKey) prometheus.Labels {
+	return prometheus.Labels{
+		"pod_namespace": key.podNamespace[0],
+		"pod_name":      key.podName[0],
+		"svc_namespace": key.svcNamespace[0],
+		"svc_scope":     key.svcScope[0],
+		"svc_name":      key.svcName[0],
+		"svc_access":    key.svcAccess[0],
+		"ip_family":     key.ipFamily}
+}
+
+func (agent *StatsAgent) ObserveRtt(key *PromMetricsKey, rtt time.Duration) {
+	if key.metricName != "pod_svc_stats" {
+		return
+	}
+	agent.promSubsystems["pod_svc_tcp_stats"].GetHistogramVec(RttHistogram).
+		With(podSvcTcpLabels(key)).Observe(rtt.Seconds())
+}
+
+func (agent *StatsAgent) SetRetransGauge(key *PromMetricsKey, retransmits uint64) {
+	if key.metricName != "pod_svc_stats" {
+		return
+	}
+	agent.promSubsystems["pod_svc_tcp_stats"].GetGaugeVec("retransmits").
+		With(podSvcTcpLabels(key)).Set(float64(retransmits))
+}
+
+func (agent *StatsAgent) DeleteRetransGauge(key *PromMetricsKey) {
+	if key.metricName != "pod_svc_stats" {
+		return
+	}
+	agent.promSubsystems["pod_svc_tcp_stats"].GetGaugeVec("retransmits").Delete(podSvcTcpLabels(key))
+}
+
+func (entry *PodSvcTcpPromSubsystemEntry) SubsystemName() string {
+	return entry.Subsystem
+}
+
+func (entry *PodSvcTcpPromSubsystemEntry) RegisterPrometheus(agent *StatsAgent) {
+	for i, metricName := range PodSvcTcpPromMetrics {
+		gauge :=
+			prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "statsagent",
+				Subsystem: "pod_svc_tcp_stats",
+				Name:      metricName,
+				Help:      PodSvcTcpPromHelp[i],
+			}, podSvcTcpPromLabels)
+		entry.Gauges[metricName] = &PromGauge{
+			Name:  metricName,
+			Cache: gauge,
+		}
+		err := prometheus.Register(gauge)
+		if err != nil {
+			agent.log.Error("Failed to register ", metricName, " with Prometheus: ", err)
+		} else {
+			agent.log.Debug("Registered ", metricName, " with Prometheus: ")
+		}
+	}
+	histogram :=
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "statsagent",
+			Subsystem: "pod_svc_tcp_stats",
+			Name:      RttHistogram,
+			Help:      RttHelp,
+			Buckets:   rttBuckets,
+		}, podSvcTcpPromLabels)
+	entry.Histograms[RttHistogram] = &PromHistogram{
+		Name:  RttHistogram,
+		Cache: histogram,
+	}
+	err := prometheus.Register(histogram)
+	if err != nil {
+		agent.log.Error("Failed to register ", RttHistogram, " with Prometheus: ", err)
+	} else {
+		agent.log.Debug("Registered ", RttHistogram, " with Prometheus: ")
+	}
+}
+
+func (entry *PodSvcTcpPromSubsystemEntry) GetGaugeVec(metricName string) *prometheus.GaugeVec {
+	return entry.Gauges[metricName].Cache
+}
+
+func NewPodSvcTcpPromSubsystemEntry() PromSubsystemEntry {
+	promSubsystem := &PromSubsystem{
+		Subsystem:  "pod_svc_tcp_stats",
+		Gauges:     make(map[string]*PromGauge),
+		Histograms: make(map[string]*PromHistogram),
+	}
+
+	return &PodSvcTcpPromSubsystemEntry{
+		PromSubsystem: promSubsystem,
+	}
+}
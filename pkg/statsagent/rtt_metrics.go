@@ -0,0 +1,168 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	"sync"
+	"time"
+)
+
+// The sockops program records the smoothed RTT and the retransmits of
+// every TCP connection of the pods in rttMapName
+const rttMapName = "tcp_rtt_map"
+
+// rttKey matches struct rtt_key, with the remote end as source like the
+// flow keys
+type rttKey struct {
+	Family uint32
+	Src_ip [4]uint32
+	Dst_ip [4]uint32
+	L4     proto_port
+}
+
+func (key *rttKey) flowKey() FlowKey {
+	if key.Family == flowMapSelV4 {
+		return &inet_v4_flow{Src_ip: key.Src_ip[0], Dst_ip: key.Dst_ip[0], L4: key.L4}
+	}
+	return &inet_v6_flow{Src_ip: key.Src_ip, Dst_ip: key.Dst_ip, L4: key.L4}
+}
+
+func (key *rttKey) ipFamily() string {
+	if key.Family == flowMapSelV4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+type rttStats struct {
+	Srtt_us       uint32
+	Total_retrans uint32
+	Last_seen_ns  uint64
+	Closed        uint32
+	Padding       uint32
+}
+
+// rttAggregate holds the retransmits of a pod to service pair
+type rttAggregate struct {
+	Retransmits uint64
+	TimeStamp   time.Time
+}
+
+// RttMetricsEntry turns the per-connection RTT and retransmits into pod
+// to service latency histograms and retransmit counters. Each connection
+// updated since the last scan adds its smoothed RTT to the histogram.
+type RttMetricsEntry struct {
+	agent        *StatsAgent
+	baseMap      map[rttKey]rttStats
+	podSvcMap    map[PodStatsKey]*rttAggregate
+	podSvcFamily map[PodStatsKey]string
+	stateMutex   sync.Mutex
+}
+
+func NewRttMetricsEntry(agent *StatsAgent) *RttMetricsEntry {
+	return &RttMetricsEntry{
+		agent:        agent,
+		baseMap:      make(map[rttKey]rttStats),
+		podSvcMap:    make(map[PodStatsKey]*rttAggregate),
+		podSvcFamily: make(map[PodStatsKey]string),
+	}
+}
+
+func (metric *RttMetricsEntry) GetStatsInterval() int {
+	return metric.agent.config.StatsInterval
+}
+
+func (metric *RttMetricsEntry) Init() {
+	metric.agent.log.Debug("Setting channel to kickoff stats for ", rttMapName)
+}
+
+func (metric *RttMetricsEntry) Run(stopCh <-chan struct{}) {
+	runMetric(metric, stopCh)
+}
+
+func (metric *RttMetricsEntry) idleTimeout() time.Duration {
+	return time.Duration(metric.agent.config.FlowIdleTimeout) * time.Second
+}
+
+// addConnection accounts a connection updated since the last scan to its
+// pod to service pair, connections to other endpoints are ignored
+func (metric *RttMetricsEntry) addConnection(key *rttKey, stats *rttStats, base rttStats, t time.Time) {
+	podStatsKey, keyType := getPodStatsKey(metric.agent, key.flowKey())
+	if keyType != FROM_SVC_KEY|TO_POD_KEY {
+		return
+	}
+	(&podStatsKey).swap()
+	promMetricsKey := podStatsKey.toPromMetricsKey(metric.agent, key.ipFamily())
+	if stats.Srtt_us != 0 {
+		metric.agent.ObserveRtt(promMetricsKey, time.Duration(stats.Srtt_us)*time.Microsecond)
+	}
+	aggregate, ok := metric.podSvcMap[podStatsKey]
+	if !ok {
+		aggregate = &rttAggregate{}
+		metric.podSvcMap[podStatsKey] = aggregate
+		metric.podSvcFamily[podStatsKey] = key.ipFamily()
+	}
+	if stats.Total_retrans > base.Total_retrans {
+		aggregate.Retransmits += uint64(stats.Total_retrans - base.Total_retrans)
+	}
+	aggregate.TimeStamp = t
+	metric.agent.SetRetransGauge(promMetricsKey, aggregate.Retransmits)
+}
+
+// UpdateStats reads the connections updated since the last scan, and
+// deletes the closed and idle ones from the map
+func (metric *RttMetricsEntry) UpdateStats() {
+	metric.stateMutex.Lock()
+	defer metric.stateMutex.Unlock()
+	m, err := metric.agent.flowMapOpener(rttMapName)
+	if err != nil {
+		metric.agent.log.Debug("Not reading ", rttMapName, ": ", err)
+		return
+	}
+	defer m.Close()
+	t := time.Now()
+	now := monotonicNow()
+	var key rttKey
+	var stats rttStats
+	var toDeleteList []rttKey
+	mIter := m.Iterate()
+	for mIter.Next(&key, &stats) {
+		base, seen := metric.baseMap[key]
+		if !seen || stats.Last_seen_ns != base.Last_seen_ns {
+			metric.addConnection(&key, &stats, base, t)
+		}
+		metric.baseMap[key] = stats
+		idle := stats.Last_seen_ns <= now && time.Duration(now-stats.Last_seen_ns) > metric.idleTimeout()
+		if stats.Closed != 0 || idle {
+			toDeleteList = append(toDeleteList, key)
+		}
+	}
+	if err = mIter.Err(); err != nil {
+		metric.agent.log.Error("Failed to iterate ", rttMapName, ": ", err)
+	}
+	for _, toDelete := range toDeleteList {
+		if err = m.Delete(toDelete); err != nil {
+			metric.agent.log.Error("Failed to delete from ", rttMapName, ": ", err)
+		}
+		delete(metric.baseMap, toDelete)
+	}
+	for k, v := range metric.podSvcMap {
+		if t.Sub(v.TimeStamp) > metric.idleTimeout() {
+			metric.agent.DeleteRetransGauge(k.toPromMetricsKey(metric.agent, metric.podSvcFamily[k]))
+			delete(metric.podSvcMap, k)
+			delete(metric.podSvcFamily, k)
+		}
+	}
+}
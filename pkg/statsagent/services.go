@@ -16,6 +16,9 @@ package statsagent
 
 import (
 	"context"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -24,7 +27,6 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/kubernetes/pkg/controller"
 )
 
 func (agent *StatsAgent) initServiceInformerFromClient(
@@ -44,7 +46,7 @@ func (agent *StatsAgent) initServiceInformerBase(listWatch *cache.ListWatch) {
 	agent.svcInformer = cache.NewSharedIndexInformer(
 		listWatch,
 		&v1.Service{},
-		controller.NoResyncPeriodFunc(),
+		noResyncPeriod,
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 	)
 	agent.svcInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -60,6 +62,125 @@ func (agent *StatsAgent) initServiceInformerBase(listWatch *cache.ListWatch) {
 	})
 }
 
+// serviceIPs returns the cluster addresses of a service, one per family
+// on dual-stack clusters. ClusterIPs is empty on clusters that predate
+// it, ClusterIP is then the only address.
+func serviceIPs(svc *v1.Service) []string {
+	var ips []string
+	for _, ip := range svc.Spec.ClusterIPs {
+		if ip != "" && ip != "None" {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 && svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None" {
+		ips = append(ips, svc.Spec.ClusterIP)
+	}
+	return ips
+}
+
+// nodePortKey identifies a node port, proto being a protocol name of the
+// protocol label
+func nodePortKey(proto string, port string) string {
+	return proto + "/" + port
+}
+
+// svcPortKey identifies a port of a service at one of its external or
+// load balancer addresses, which other services or the node may share on
+// other ports
+func svcPortKey(proto string, ip string, port string) string {
+	return proto + "/" + net.JoinHostPort(ip, port)
+}
+
+// svcPorts returns the svcPortKeys of the ports of a service at ips
+func svcPorts(svc *v1.Service, ips []string) []string {
+	var keys []string
+	for _, ip := range ips {
+		for _, port := range svc.Spec.Ports {
+			keys = append(keys, svcPortKey(strings.ToLower(string(port.Protocol)), ip, strconv.Itoa(int(port.Port))))
+		}
+	}
+	return keys
+}
+
+func loadBalancerIPs(svc *v1.Service) []string {
+	var ips []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	return ips
+}
+
+func nodePorts(svc *v1.Service) []string {
+	var ports []string
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort != 0 {
+			ports = append(ports, nodePortKey(strings.ToLower(string(port.Protocol)), strconv.Itoa(int(port.NodePort))))
+		}
+	}
+	return ports
+}
+
+// indexService indexes the addresses and ports of a service and removes
+// those it no longer has. Called with stateMutex held.
+func (agent *StatsAgent) indexService(key string, oldInfo SvcInfo, svcInfo SvcInfo) {
+	removeIPs(agent.svcIpToName, key, oldInfo.ClusterIPs, svcInfo.ClusterIPs)
+	oldPorts := append(append([]string{}, oldInfo.ExternalPorts...), oldInfo.LoadBalancerPorts...)
+	newPorts := append(append([]string{}, svcInfo.ExternalPorts...), svcInfo.LoadBalancerPorts...)
+	removeIPs(agent.svcPortToSvc, key, oldPorts, newPorts)
+	for _, port := range oldPorts {
+		if _, ok := agent.svcPortToSvc[port]; !ok {
+			delete(agent.svcPortAccess, port)
+		}
+	}
+	removeIPs(agent.nodePortToSvc, key, oldInfo.NodePorts, svcInfo.NodePorts)
+	// External addresses win over load balancer addresses of other
+	// services on the same port
+	for _, port := range svcInfo.LoadBalancerPorts {
+		agent.svcPortToSvc[port] = key
+		agent.svcPortAccess[port] = SvcAccessLoadBalancer
+	}
+	for _, port := range svcInfo.ExternalPorts {
+		agent.svcPortToSvc[port] = key
+		agent.svcPortAccess[port] = SvcAccessExternalIP
+	}
+	for _, ip := range svcInfo.ClusterIPs {
+		agent.svcIpToName[ip] = key
+	}
+	for _, port := range svcInfo.NodePorts {
+		agent.nodePortToSvc[port] = key
+	}
+}
+
+// svcReachable reports whether the service of a PodStatsKey endpoint still
+// exists and can still be reached the way the endpoint says, endpoints
+// that are not services always are. Called with stateMutex held.
+func (agent *StatsAgent) svcReachable(endpoint string) bool {
+	splitStrings := strings.SplitN(endpoint, "/", 4)
+	if len(splitStrings) < 3 {
+		return true
+	}
+	svcInfo, ok := agent.svcInfo[splitStrings[0]+"/"+splitStrings[1]]
+	if !ok {
+		return false
+	}
+	if len(splitStrings) < 4 {
+		return true
+	}
+	switch splitStrings[3] {
+	case SvcAccessClusterIP:
+		return len(svcInfo.ClusterIPs) != 0
+	case SvcAccessExternalIP:
+		return len(svcInfo.ExternalPorts) != 0
+	case SvcAccessLoadBalancer:
+		return len(svcInfo.LoadBalancerPorts) != 0
+	case SvcAccessNodePort:
+		return len(svcInfo.NodePorts) != 0
+	}
+	return true
+}
+
 func (agent *StatsAgent) serviceUpdated(obj interface{}) {
 	agent.stateMutex.Lock()
 	defer agent.stateMutex.Unlock()
@@ -76,7 +197,10 @@ func (agent *StatsAgent) serviceUpdated(obj interface{}) {
 		return
 	}
 	var svcInfo SvcInfo
-	svcInfo.ClusterIP = svc.Spec.ClusterIP
+	svcInfo.ClusterIPs = serviceIPs(svc)
+	svcInfo.ExternalPorts = svcPorts(svc, svc.Spec.ExternalIPs)
+	svcInfo.LoadBalancerPorts = svcPorts(svc, loadBalancerIPs(svc))
+	svcInfo.NodePorts = nodePorts(svc)
 	switch svc.Spec.Type {
 	case v1.ServiceTypeClusterIP:
 		svcInfo.SvcType = "clusterIp"
@@ -88,8 +212,8 @@ func (agent *StatsAgent) serviceUpdated(obj interface{}) {
 		svcInfo.SvcType = "externalName"
 	}
 	agent.log.Debug("Added svc ", key)
+	agent.indexService(key, agent.svcInfo[key], svcInfo)
 	agent.svcInfo[key] = svcInfo
-	agent.svcIpToName[svcInfo.ClusterIP] = key
 }
 
 func (agent *StatsAgent) serviceDeleted(obj interface{}) {
@@ -103,12 +227,13 @@ func (agent *StatsAgent) serviceDeleted(obj interface{}) {
 			Error("Could not create key:" + err.Error())
 		return
 	}
-	if svc.Spec.ClusterIP == "None" {
+	svcInfo, ok := agent.svcInfo[key]
+	if !ok {
 		return
 	}
 	agent.log.Debug("Deleting svc ", key)
+	agent.indexService(key, svcInfo, SvcInfo{})
 	delete(agent.svcInfo, key)
-	delete(agent.svcIpToName, svc.Spec.ClusterIP)
 }
 
 func serviceLogger(log *logrus.Logger, as *v1.Service) *logrus.Entry {
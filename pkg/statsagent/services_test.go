@@ -0,0 +1,206 @@
+// Copyright 2021 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsagent
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func testService(name string, clusterIP string, externalIP string, port int32) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: v1.ServiceSpec{
+			Type:        v1.ServiceTypeClusterIP,
+			ClusterIP:   clusterIP,
+			ClusterIPs:  []string{clusterIP},
+			ExternalIPs: []string{externalIP},
+			Ports:       []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: port}},
+		},
+	}
+}
+
+// testLoadBalancer returns a load balancer service with an external
+// address, reached on TCP port 80 and node port 30080
+func testLoadBalancer(name string) *v1.Service {
+	svc := testService(name, "10.96.0.30", "192.168.1.50", 80)
+	svc.Spec.Type = v1.ServiceTypeLoadBalancer
+	svc.Spec.Ports[0].NodePort = 30080
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "203.0.113.10"}, {Hostname: "lb.example.com"}}
+	return svc
+}
+
+func TestResolveSvc(t *testing.T) {
+	agent, _ := newTestAgent()
+	nodeIp := "192.168.0.10"
+	agent.nodeIpToName[nodeIp] = "node-1"
+	agent.serviceUpdated(testLoadBalancer("lb"))
+	for _, tc := range []struct {
+		name   string
+		ip     string
+		proto  string
+		port   string
+		access string
+	}{
+		{"cluster ip", "10.96.0.30", protoTcp, "80", SvcAccessClusterIP},
+		{"external ip", "192.168.1.50", protoTcp, "80", SvcAccessExternalIP},
+		{"external ip other protocol", "192.168.1.50", protoUdp, "80", ""},
+		{"external ip other port", "192.168.1.50", protoTcp, "81", ""},
+		{"load balancer", "203.0.113.10", protoTcp, "80", SvcAccessLoadBalancer},
+		{"load balancer node port", "203.0.113.10", protoTcp, "30080", ""},
+		{"node port", nodeIp, protoTcp, "30080", SvcAccessNodePort},
+		{"node port other protocol", nodeIp, protoUdp, "30080", ""},
+		{"node port of a pod", testServerIp, protoTcp, "30080", ""},
+		{"service port of the node", nodeIp, protoTcp, "80", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svcEp, ok := agent.resolveSvc(tc.ip, tc.proto, tc.port)
+			if tc.access == "" {
+				if ok {
+					t.Errorf("resolved to %q", svcEp)
+				}
+				return
+			}
+			if want := svcEndpoint("default/lb", "loadBalancer", tc.access); !ok || svcEp != want {
+				t.Errorf("resolved to %q, want %q", svcEp, want)
+			}
+		})
+	}
+}
+
+func TestServiceUpdatedUnindexesPorts(t *testing.T) {
+	agent, _ := newTestAgent()
+	agent.serviceUpdated(testLoadBalancer("lb"))
+	if len(agent.svcPortToSvc) != 2 || len(agent.svcPortAccess) != 2 || len(agent.nodePortToSvc) != 1 {
+		t.Fatalf("indexed %v %v %v", agent.svcPortToSvc, agent.svcPortAccess, agent.nodePortToSvc)
+	}
+
+	// The service turned back into a cluster IP service
+	svc := testService("lb", "10.96.0.30", "", 80)
+	svc.Spec.ExternalIPs = nil
+	agent.serviceUpdated(svc)
+	if len(agent.svcPortToSvc) != 0 || len(agent.svcPortAccess) != 0 || len(agent.nodePortToSvc) != 0 {
+		t.Errorf("kept %v %v %v", agent.svcPortToSvc, agent.svcPortAccess, agent.nodePortToSvc)
+	}
+	if !agent.svcReachable(svcEndpoint("default/lb", "clusterIp", SvcAccessClusterIP)) {
+		t.Error("cluster ip of the service not reachable")
+	}
+	for _, access := range []string{SvcAccessExternalIP, SvcAccessLoadBalancer, SvcAccessNodePort} {
+		if agent.svcReachable(svcEndpoint("default/lb", "loadBalancer", access)) {
+			t.Errorf("service reachable by %s", access)
+		}
+	}
+
+	agent.serviceDeleted(svc)
+	if svcName, ok := agent.svcIpToName["10.96.0.30"]; ok {
+		t.Errorf("address of deleted service indexed to %q", svcName)
+	}
+	if agent.svcReachable(svcEndpoint("default/lb", "clusterIp", SvcAccessClusterIP)) {
+		t.Error("deleted service reachable")
+	}
+}
+
+func TestResolveSvcBySharedExternalIP(t *testing.T) {
+	agent, _ := newTestAgent()
+	nodeIp := "192.168.0.10"
+	agent.nodeIpToName[nodeIp] = "node-1"
+	agent.serviceUpdated(testService("http", "10.96.0.20", nodeIp, 80))
+	agent.serviceUpdated(testService("https", "10.96.0.21", nodeIp, 443))
+
+	for port, want := range map[string]string{
+		"80":  svcEndpoint("default/http", "clusterIp", SvcAccessExternalIP),
+		"443": svcEndpoint("default/https", "clusterIp", SvcAccessExternalIP),
+	} {
+		svcEp, ok := agent.resolveSvc(nodeIp, protoTcp, port)
+		if !ok || svcEp != want {
+			t.Errorf("port %s resolved to %q, want %q", port, svcEp, want)
+		}
+	}
+	// Other traffic of the node stays node traffic
+	if svcEp, ok := agent.resolveSvc(nodeIp, protoTcp, "10250"); ok {
+		t.Errorf("kubelet port resolved to %q", svcEp)
+	}
+
+	agent.serviceDeleted(testService("http", "10.96.0.20", nodeIp, 80))
+	if svcEp, ok := agent.resolveSvc(nodeIp, protoTcp, "80"); ok {
+		t.Errorf("port of deleted service resolved to %q", svcEp)
+	}
+	if _, ok := agent.resolveSvc(nodeIp, protoTcp, "443"); !ok {
+		t.Error("port of remaining service not resolved")
+	}
+}
+
+func TestServiceIPs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		clusterIP  string
+		clusterIPs []string
+		want       []string
+	}{
+		{"dual-stack", "10.96.0.20", []string{"10.96.0.20", "fd00:96::20"}, []string{"10.96.0.20", "fd00:96::20"}},
+		{"without clusterIPs", "10.96.0.20", nil, []string{"10.96.0.20"}},
+		{"headless", "None", []string{"None"}, nil},
+		{"no address", "", nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &v1.Service{Spec: v1.ServiceSpec{ClusterIP: tc.clusterIP, ClusterIPs: tc.clusterIPs}}
+			if ips := serviceIPs(svc); !reflect.DeepEqual(ips, tc.want) {
+				t.Errorf("addresses %v, want %v", ips, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceUpdatedDualStack(t *testing.T) {
+	agent, _ := newTestAgent()
+	svc := testService("dns", "10.96.0.20", "", 53)
+	svc.Spec.ExternalIPs = nil
+	svc.Spec.ClusterIPs = []string{"10.96.0.20", "fd00:96::20"}
+	agent.serviceUpdated(svc)
+	for _, ip := range svc.Spec.ClusterIPs {
+		if svcName := agent.svcIpToName[ip]; svcName != "default/dns" {
+			t.Errorf("%s indexed to %q", ip, svcName)
+		}
+	}
+
+	// Dropping a family removes its address only
+	svc = svc.DeepCopy()
+	svc.Spec.ClusterIPs = svc.Spec.ClusterIPs[:1]
+	agent.serviceUpdated(svc)
+	if svcName := agent.svcIpToName["10.96.0.20"]; svcName != "default/dns" {
+		t.Errorf("kept address indexed to %q", svcName)
+	}
+	if svcName, ok := agent.svcIpToName["fd00:96::20"]; ok {
+		t.Errorf("dropped address indexed to %q", svcName)
+	}
+}
+
+func TestServiceDeletedKeepsReusedAddress(t *testing.T) {
+	agent, _ := newTestAgent()
+	old := testService("old", "10.96.0.20", "", 80)
+	old.Spec.ExternalIPs = nil
+	agent.serviceUpdated(old)
+	// The address of the old service was given to a new one before the
+	// deletion of the old one was seen
+	reused := old.DeepCopy()
+	reused.Name = "new"
+	agent.serviceUpdated(reused)
+	agent.serviceDeleted(old)
+	if svcName := agent.svcIpToName["10.96.0.20"]; svcName != "default/new" {
+		t.Errorf("reused address indexed to %q", svcName)
+	}
+}
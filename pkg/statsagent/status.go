@@ -15,14 +15,16 @@
 package statsagent
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 )
 
 type agentStatus struct {
-	PodCount int `json:"pod-count,omitempty"`
+	PodCount int        `json:"pod-count,omitempty"`
+	Bpf      *BpfStatus `json:"bpf,omitempty"`
+	Warnings []string   `json:"warnings,omitempty"`
 }
 
 func (agent *StatsAgent) RunStatus() {
@@ -38,10 +40,22 @@ func (agent *StatsAgent) RunStatus() {
 		agent.stateMutex.Lock()
 		status := &agentStatus{
 			PodCount: len(agent.podInfo),
+			Warnings: agent.getWarnings(),
+		}
+		if agent.bpfLoader != nil {
+			bpfStatus := agent.bpfLoader.GetStatus()
+			status.Bpf = &bpfStatus
 		}
 		json.NewEncoder(w).Encode(status)
 		agent.stateMutex.Unlock()
 	})
 	agent.log.Info("Starting status server on ", agent.config.StatusPort)
-	panic(http.ListenAndServe(fmt.Sprintf(":%d", agent.config.StatusPort), nil))
+	err := agent.statusServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+func (agent *StatsAgent) StopStatus() {
+	agent.statusServer.Shutdown(context.Background())
 }
@@ -1,4 +0,0 @@
-#!/bin/sh
-# Load bpf program from within the golang code
-#/bin/load_attach_bpf_cgroup.sh
-/bin/statsagent